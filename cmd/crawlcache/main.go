@@ -0,0 +1,391 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+// Command crawlcache inspects and maintains an httpcache.DiskCache
+// directory.
+//
+//	crawlcache -dir DIR list [GLOB]
+//	crawlcache -dir DIR show URL
+//	crawlcache -dir DIR delete URL|GLOB...
+//	crawlcache -dir DIR verify
+//	crawlcache -dir DIR evict [-max-size BYTES] [-max-entries N] [-policy lru|lfu]
+//	crawlcache -dir DIR stats
+//	crawlcache -dir DIR export FILE.warc.gz
+//	crawlcache -dir DIR import FILE.warc.gz
+//
+// GLOB matches URLs with the syntax of path.Match, except that * matches
+// / too. URLs are compared normalized.
+package main // import "xojoc.pw/crawl/cmd/crawlcache"
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"xojoc.pw/crawl/httpcache"
+	"xojoc.pw/crawl/urlnorm"
+	"xojoc.pw/crawl/warc"
+)
+
+var errUsage = errors.New("usage: crawlcache -dir DIR list|show|delete|verify|evict|stats|export|import [ARGS]")
+
+func main() {
+	err := run(context.Background(), os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("crawlcache", flag.ContinueOnError)
+	dir := fs.String("dir", "", "cache directory")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	args = fs.Args()
+	if *dir == "" || len(args) == 0 {
+		return errUsage
+	}
+	d := httpcache.NewDiskCache(*dir)
+	defer d.Close()
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		return list(ctx, d, args, out)
+	case "show":
+		return show(ctx, d, args, out)
+	case "delete":
+		return del(ctx, d, args, out)
+	case "verify":
+		n, err := d.Verify(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "%d corrupt entries quarantined\n", n)
+		return nil
+	case "evict":
+		return evict(d, args)
+	case "stats":
+		return stats(ctx, d, out)
+	case "export":
+		return export(ctx, d, args, out)
+	case "import":
+		return load(ctx, d, args, out)
+	}
+	return errUsage
+}
+
+// normalize returns u normalized, or u if it can't be parsed.
+func normalize(u string) string {
+	n, err := urlnorm.String(u, urlnorm.Default)
+	if err != nil {
+		return u
+	}
+	return n
+}
+
+// glob compiles the glob pattern p to a regular expression.
+func glob(p string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(p) {
+				i++
+				b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+			}
+		case '[':
+			j := strings.IndexByte(p[i:], ']')
+			if j < 0 {
+				return nil, fmt.Errorf("crawlcache: bad pattern %q", p)
+			}
+			// the syntax of classes is the same
+			b.WriteString(p[i : i+j+1])
+			i += j
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// matcher returns a function reporting whether a URL matches one of the
+// patterns, URLs or globs.
+func matcher(patterns []string) (func(u string) bool, error) {
+	urls := map[string]bool{}
+	var globs []*regexp.Regexp
+	for _, p := range patterns {
+		if !strings.ContainsAny(p, "*?[\\") {
+			urls[normalize(p)] = true
+			continue
+		}
+		re, err := glob(p)
+		if err != nil {
+			return nil, err
+		}
+		globs = append(globs, re)
+	}
+	return func(u string) bool {
+		if len(patterns) == 0 {
+			return true
+		}
+		n := normalize(u)
+		if urls[n] {
+			return true
+		}
+		for _, re := range globs {
+			if re.MatchString(u) || re.MatchString(n) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func list(ctx context.Context, d *httpcache.DiskCache, args []string, out io.Writer) error {
+	matches, err := matcher(args)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(out, 0, 8, 1, ' ', 0)
+	err = d.Walk(ctx, func(m *httpcache.Meta) error {
+		if !matches(m.URL) {
+			return nil
+		}
+		u := m.URL
+		if u == "" {
+			u = "?"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", u, m.Status, m.Size, m.FetchedAt.UTC().Format(time.RFC3339))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func show(ctx context.Context, d *httpcache.DiskCache, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	m, err := d.Meta(ctx, args[0])
+	if err == nil {
+		b, _ := json.MarshalIndent(m, "", "  ")
+		fmt.Fprintf(out, "%s\n\n", b)
+	}
+	r, err := d.Peek(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	return r.Write(out)
+}
+
+func del(ctx context.Context, d *httpcache.DiskCache, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	matches, err := matcher(args)
+	if err != nil {
+		return err
+	}
+	var us []string
+	err = d.Walk(ctx, func(m *httpcache.Meta) error {
+		if m.URL != "" && matches(m.URL) {
+			us = append(us, m.URL)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, u := range us {
+		err = d.Delete(ctx, u)
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "%d entries deleted\n", len(us))
+	return nil
+}
+
+func evict(d *httpcache.DiskCache, args []string) error {
+	fs := flag.NewFlagSet("evict", flag.ContinueOnError)
+	fs.Int64Var(&d.MaxSize, "max-size", 0, "maximum size of the cache in bytes")
+	fs.IntVar(&d.MaxEntries, "max-entries", 0, "maximum number of entries")
+	policy := fs.String("policy", "lru", "lru or lfu")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	switch *policy {
+	case "lru":
+		d.Policy = httpcache.LRU
+	case "lfu":
+		d.Policy = httpcache.LFU
+	default:
+		return fmt.Errorf("crawlcache: unknown policy %q", *policy)
+	}
+	return d.Evict()
+}
+
+func stats(ctx context.Context, d *httpcache.DiskCache, out io.Writer) error {
+	type hostStats struct {
+		host    string
+		entries int
+		size    int64
+	}
+	byHost := map[string]*hostStats{}
+	err := d.Walk(ctx, func(m *httpcache.Meta) error {
+		h := "?"
+		if u, err := url.Parse(m.URL); err == nil && u.Host != "" {
+			h = u.Host
+		}
+		s, ok := byHost[h]
+		if !ok {
+			s = &hostStats{host: h}
+			byHost[h] = s
+		}
+		s.entries++
+		s.size += m.Size
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	hs := make([]*hostStats, 0, len(byHost))
+	for _, s := range byHost {
+		hs = append(hs, s)
+	}
+	sort.Slice(hs, func(i, j int) bool {
+		if hs[i].entries != hs[j].entries {
+			return hs[i].entries > hs[j].entries
+		}
+		return hs[i].host < hs[j].host
+	})
+	tw := tabwriter.NewWriter(out, 0, 8, 1, ' ', 0)
+	for _, s := range hs {
+		fmt.Fprintf(tw, "%s\t%d\t%d\n", s.host, s.entries, s.size)
+	}
+	return tw.Flush()
+}
+
+func export(ctx context.Context, d *httpcache.DiskCache, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bw := bufio.NewWriter(f)
+	w := warc.NewWriter(bw)
+	_, err = w.WriteInfo(map[string]string{"software": "crawlcache", "format": "WARC File Format 1.1"})
+	if err != nil {
+		return err
+	}
+	n := 0
+	err = d.Walk(ctx, func(m *httpcache.Meta) error {
+		if m.URL == "" {
+			return nil
+		}
+		r, err := d.Peek(ctx, m.URL)
+		if err == httpcache.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rec, err := httpcache.NewRecord(m.URL, m.FetchedAt, r)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(rec)
+		if err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%d entries exported\n", n)
+	return f.Close()
+}
+
+func load(ctx context.Context, d *httpcache.DiskCache, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	wr := warc.NewReader(f)
+	n := 0
+	for {
+		rec, err := wr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if rec.Type != warc.Response || !strings.HasPrefix(rec.TargetURI, "http") {
+			continue
+		}
+		r, err := rec.Response()
+		if err != nil {
+			return err
+		}
+		err = d.Put(ctx, httpcache.RecordKey(rec), r)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		n++
+	}
+	fmt.Fprintf(out, "%d entries imported\n", n)
+	return nil
+}
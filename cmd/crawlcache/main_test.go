@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"xojoc.pw/crawl/httpcache"
+	"xojoc.pw/crawl/warc"
+)
+
+func TestRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crawlcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	src := filepath.Join(dir, "src")
+	d := httpcache.NewDiskCache(src)
+	for _, u := range []string{"http://a.com/1", "http://a.com/2", "http://b.com/"} {
+		r := &http.Response{
+			StatusCode: 200,
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("body of " + u)),
+		}
+		if err := d.Put(ctx, u, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.Close()
+
+	cmd := func(args ...string) string {
+		var out bytes.Buffer
+		err := run(ctx, args, &out)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return out.String()
+	}
+
+	out := cmd("-dir", src, "list", "http://a.com/*")
+	if strings.Count(out, "\n") != 2 || !strings.Contains(out, "http://a.com/2 200 22") {
+		t.Errorf("list: got %q", out)
+	}
+	if out := cmd("-dir", src, "stats"); !strings.HasPrefix(out, "a.com 2 44\nb.com 1 21\n") {
+		t.Errorf("stats: got %q", out)
+	}
+	if out := cmd("-dir", src, "show", "http://b.com/"); !strings.Contains(out, "body of http://b.com/") {
+		t.Errorf("show: got %q", out)
+	}
+	if out := cmd("-dir", src, "verify"); out != "0 corrupt entries quarantined\n" {
+		t.Errorf("verify: got %q", out)
+	}
+
+	file := filepath.Join(dir, "out.warc.gz")
+	if out := cmd("-dir", src, "export", file); out != "3 entries exported\n" {
+		t.Errorf("export: got %q", out)
+	}
+	dst := filepath.Join(dir, "dst")
+	if out := cmd("-dir", dst, "import", file); out != "3 entries imported\n" {
+		t.Errorf("import: got %q", out)
+	}
+	if a, b := cmd("-dir", src, "list"), cmd("-dir", dst, "list"); len(strings.Split(a, "\n")) != len(strings.Split(b, "\n")) {
+		t.Errorf("import: want\n%s\ngot\n%s", a, b)
+	}
+	r, err := httpcache.NewDiskCache(dst).Get(ctx, "http://a.com/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != "body of http://a.com/1" {
+		t.Errorf("imported body: got %q", b)
+	}
+
+	dd := httpcache.NewDiskCache(dst)
+	dd.Put(ctx, "http://a.com/x/y", &http.Response{StatusCode: 200, ProtoMajor: 1, ProtoMinor: 1, Header: http.Header{}})
+	dd.Close()
+	if out := cmd("-dir", dst, "delete", "http://a.com/*"); out != "3 entries deleted\n" {
+		t.Errorf("delete: got %q", out)
+	}
+	if out := cmd("-dir", dst, "delete", "HTTP://B.com:80/"); out != "1 entries deleted\n" {
+		t.Errorf("delete normalized: got %q", out)
+	}
+	cmd("-dir", src, "evict", "-max-entries", "1")
+	if out := cmd("-dir", src, "list"); strings.Count(out, "\n") != 1 {
+		t.Errorf("evict: got %q", out)
+	}
+}
+
+func TestRun_Variant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crawlcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	src := filepath.Join(dir, "src")
+	d := httpcache.NewDiskCache(src)
+	k := "http://a.com/ vary:Accept-Language=it"
+	r := &http.Response{
+		StatusCode: 200,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       ioutil.NopCloser(strings.NewReader("ciao")),
+	}
+	if err := d.Put(ctx, k, r); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	p := filepath.Join(dir, "out.warc.gz")
+	if err := run(ctx, []string{"-dir", src, "export", p}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	wr := warc.NewReader(f)
+	wr.Next() // warcinfo
+	rec, err := wr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.TargetURI != "http://a.com/" || rec.Get(httpcache.HeaderVariant) != "Accept-Language=it" {
+		t.Errorf("export: got WARC-Target-URI %q and variant %q", rec.TargetURI, rec.Get(httpcache.HeaderVariant))
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := run(ctx, []string{"-dir", dst, "import", p}, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	d = httpcache.NewDiskCache(dst)
+	defer d.Close()
+	if ok, _ := d.Has(ctx, "http://a.com/"); ok {
+		t.Errorf("import: variant imported as the URL")
+	}
+	r, err = d.Get(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != "ciao" {
+		t.Errorf("imported body: got %q", b)
+	}
+}
@@ -13,4 +13,434 @@ GNU Affero General Public License for more details.
 You should have received a copy of the GNU Affero General Public License
 along with this program.  If not, see <https://www.gnu.org/licenses/>. */
 
+// Package crawl walks the web starting from a set of seed URLs.
 package crawl // import "xojoc.pw/crawl"
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"xojoc.pw/crawl/html"
+	"xojoc.pw/crawl/httpcache"
+	"xojoc.pw/crawl/robots"
+)
+
+// FetchFunc performs an HTTP request. (*http.Client).Do is a FetchFunc.
+type FetchFunc func(*http.Request) (*http.Response, error)
+
+// Page is a fetched URL as seen by the per-page callback.
+type Page struct {
+	URL   *url.URL
+	Depth int
+
+	// Response has its Body already read into Body and closed.
+	Response *http.Response
+	Body     []byte
+	// Links are the references found in the page if it is HTML.
+	Links []*html.Link
+
+	// Err is set if the page could not be fetched.
+	Err error
+}
+
+// Crawler visits Seeds and every page reachable from them.
+type Crawler struct {
+	Seeds []string
+	// Fetch defaults to the Do method of a client that doesn't follow
+	// redirects: the target of a redirect is queued like a link, so that
+	// Scope and robots.txt apply to it. It fetches robots.txt too, which
+	// follows at most robots.MaxRedirects redirects unless Fetch follows
+	// them itself.
+	Fetch FetchFunc
+	// Handle is called once for each visited page. If it returns an
+	// error the crawl stops and Run returns that error.
+	Handle func(*Page) error
+	// Cache, if not nil, is consulted before calling Fetch and stores
+	// the responses fetched.
+	Cache httpcache.Cache
+
+	// Workers is the number of concurrent fetches. Defaults to 1.
+	Workers   int
+	UserAgent string
+	// Delay is the time to wait between two requests to the same host
+	// when robots.txt doesn't specify a longer Crawl-delay.
+	Delay time.Duration
+	// MaxConns is the maximum number of concurrent requests per host.
+	// Defaults to 1.
+	MaxConns int
+	// Scope, if not nil, decides which URLs are crawled.
+	Scope Scope
+	// Rejected, if not nil, is called for each URL not crawled because
+	// out of Scope or disallowed by robots.txt. The URLs of a host whose
+	// robots.txt is unreachable are not rejected but tried again an hour
+	// later.
+	Rejected func(e *Entry, why error)
+	// Frontier records the progress of the crawl. If it already holds
+	// pending entries, from a previous run, the crawl resumes from them.
+	// Defaults to an in-memory frontier.
+	Frontier Frontier
+
+	mu       sync.Mutex
+	hosts    map[string]*host
+	frontier Frontier
+	sched    *Scheduler
+	checker  *robots.Checker
+}
+
+type host struct {
+	once sync.Once
+	mu   sync.Mutex
+	txt  *robots.Txt // the latest seen by step
+}
+
+// Entry is a URL waiting to be visited.
+type Entry struct {
+	URL *url.URL
+	// Depth is the number of links followed from a seed.
+	Depth int
+	// Source is the page where URL was found, empty for seeds.
+	Source string
+	// Seed is the seed from which URL was reached.
+	Seed string
+}
+
+var (
+	// ErrNoSeeds is returned by Run when there is nothing to crawl.
+	ErrNoSeeds = errors.New("crawl: no seeds")
+	// ErrDisallowed is the reason given for URLs disallowed by robots.txt.
+	ErrDisallowed = errors.New("disallowed by robots.txt")
+)
+
+const (
+	// robotsRetry is how long the URLs of a host with an unreachable
+	// robots.txt wait before being tried again.
+	robotsRetry = time.Hour
+	// robotsTimeout bounds the fetch of robots.txt, which holds the
+	// worker.
+	robotsTimeout = 30 * time.Second
+)
+
+// Run crawls until there are no more URLs to visit or ctx is cancelled.
+func (c *Crawler) Run(ctx context.Context) error {
+	c.mu.Lock()
+	c.hosts = map[string]*host{}
+	c.frontier = c.Frontier
+	if c.frontier == nil {
+		c.frontier = newMemFrontier()
+	}
+	c.sched = &Scheduler{DefaultDelay: c.Delay, MaxConns: c.MaxConns}
+	c.checker = &robots.Checker{
+		Client:    &http.Client{Timeout: robotsTimeout},
+		UserAgent: c.UserAgent,
+		ErrorTTL:  robotsRetry,
+	}
+	if c.Fetch != nil {
+		// robots.txt is never taken from Cache, which would keep it,
+		// or its errors, forever
+		c.checker.Client.Transport = roundTripper(c.Fetch)
+	}
+	c.mu.Unlock()
+
+	pending, err := c.frontier.Pending()
+	if err != nil {
+		return err
+	}
+	for _, e := range pending {
+		c.sched.Push(e)
+	}
+	for _, s := range c.Seeds {
+		u, err := url.Parse(s)
+		if err != nil {
+			return err
+		}
+		err = c.push(&Entry{URL: u, Seed: u.String()})
+		if err != nil {
+			return err
+		}
+	}
+	if len(c.Seeds) == 0 && len(pending) == 0 {
+		return ErrNoSeeds
+	}
+
+	workers := c.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var once sync.Once
+	fail := func(ferr error) {
+		once.Do(func() {
+			err = ferr
+			cancel()
+		})
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				e, err := c.sched.Next(cctx)
+				if err != nil {
+					return
+				}
+				err = c.step(cctx, e)
+				c.sched.Done(e)
+				if err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// step visits e and queues the links found.
+func (c *Crawler) step(ctx context.Context, e *Entry) error {
+	txt, err := c.checker.Txt(ctx, e.URL)
+	if err != nil {
+		if ctx.Err() == nil {
+			// robots.txt is unreachable
+			c.sched.Retry(e, time.Now().Add(robotsRetry))
+		}
+		// otherwise e is still pending, it is queued again on resume
+		return nil
+	}
+	c.schedule(e.URL, txt)
+	if at := txt.Next(c.UserAgent, time.Time{}, 0); at.After(time.Now()) {
+		// released before robots.txt was known, outside of Visit-time
+		c.sched.Retry(e, at)
+		return nil
+	}
+	if e.URL.Path != "/robots.txt" && !txt.Allowed(c.UserAgent, e.URL.RequestURI()) {
+		return c.reject(e, ErrDisallowed)
+	}
+	err = c.frontier.Start(e)
+	if err != nil {
+		return err
+	}
+	out, err := c.visit(ctx, e)
+	if err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		// leave e in flight, it is queued again on resume
+		return nil
+	}
+	for _, o := range out {
+		err = c.push(o)
+		if err != nil {
+			return err
+		}
+	}
+	return c.frontier.Complete(e)
+}
+
+// push queues e unless its URL is already known to the frontier or out of
+// scope. The frontier compares normalized URLs but e keeps the URL as
+// found, which is the one fetched, only without the fragment, which is
+// never sent anyway.
+func (c *Crawler) push(e *Entry) error {
+	if e.URL.Fragment != "" {
+		u := *e.URL
+		u.Fragment, u.RawFragment = "", ""
+		e.URL = &u
+	}
+	ok, err := c.frontier.Add(e)
+	if err != nil || !ok {
+		return err
+	}
+	if c.Scope != nil {
+		if why := c.Scope.Check(e); why != nil {
+			return c.reject(e, why)
+		}
+	}
+	c.sched.Push(e)
+	return nil
+}
+
+func (c *Crawler) host(u *url.URL) *host {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.hosts[HostKey(u)]
+	if !ok {
+		h = &host{}
+		c.hosts[HostKey(u)] = h
+	}
+	return h
+}
+
+func (c *Crawler) fetch(ctx context.Context, u *url.URL) (*http.Response, error) {
+	if c.Cache != nil {
+		r, err := c.Cache.Get(ctx, u.String())
+		if err == nil {
+			return r, nil
+		}
+		if err != httpcache.ErrNotFound {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	fetch := c.Fetch
+	if fetch == nil {
+		fetch = noRedirects.Do
+	}
+	r, err := fetch(req)
+	if err != nil {
+		return nil, err
+	}
+	if c.Cache != nil {
+		err = c.Cache.Put(ctx, u.String(), r)
+		if err != nil {
+			r.Body.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (c *Crawler) reject(e *Entry, why error) error {
+	if c.Rejected != nil {
+		c.Rejected(e, why)
+	}
+	return c.frontier.Reject(e, why)
+}
+
+// schedule records txt, the robots.txt of u, for the scheduler and sets,
+// once per host, when the scheduler releases the host's URLs: no sooner
+// than the longest of Delay and the delay of robots.txt and within its
+// Visit-times.
+func (c *Crawler) schedule(u *url.URL, txt *robots.Txt) {
+	h := c.host(u)
+	h.mu.Lock()
+	h.txt = txt
+	h.mu.Unlock()
+	h.once.Do(func() {
+		c.sched.SetNext(HostKey(u), func(last time.Time) time.Time {
+			h.mu.Lock()
+			txt := h.txt
+			h.mu.Unlock()
+			return txt.Next(c.UserAgent, last, c.Delay)
+		})
+	})
+}
+
+// roundTripper adapts a function to http.RoundTripper.
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func (c *Crawler) visit(ctx context.Context, e *Entry) ([]*Entry, error) {
+	p := &Page{URL: e.URL, Depth: e.Depth}
+	var loc *url.URL
+	r, err := c.fetch(ctx, e.URL)
+	if err != nil {
+		p.Err = err
+	} else {
+		p.Response = r
+		p.Body, p.Err = ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		base := p.URL
+		if r.Request != nil && r.Request.URL != nil {
+			// the final URL if Fetch followed redirects
+			base = r.Request.URL
+		}
+		if p.Err == nil && isHTML(r) {
+			p.Links = links(base, p.Body)
+		}
+		loc = redirect(base, r)
+	}
+
+	if c.Handle != nil {
+		if err := c.Handle(p); err != nil {
+			return nil, err
+		}
+	}
+
+	var out []*Entry
+	for _, l := range p.Links {
+		if !follow(l) {
+			continue
+		}
+		out = append(out, &Entry{URL: l.URL, Depth: e.Depth + 1, Source: e.URL.String(), Seed: e.Seed})
+	}
+	if loc != nil && (loc.Scheme == "http" || loc.Scheme == "https") {
+		out = append(out, &Entry{URL: loc, Depth: e.Depth + 1, Source: e.URL.String(), Seed: e.Seed})
+	}
+	return out, nil
+}
+
+// noRedirects is the client used without Fetch.
+var noRedirects = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// redirect returns the target of r, fetched from base, if it is a
+// redirect.
+func redirect(base *url.URL, r *http.Response) *url.URL {
+	if r.StatusCode < 300 || r.StatusCode >= 400 || r.Header.Get("Location") == "" {
+		return nil
+	}
+	u, err := base.Parse(r.Header.Get("Location"))
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+func isHTML(r *http.Response) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	return t == "text/html" || t == "application/xhtml+xml"
+}
+
+func links(base *url.URL, body []byte) []*html.Link {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	return doc.Links(base)
+}
+
+// follow reports whether l leads to a page worth crawling.
+func follow(l *html.Link) bool {
+	if l.NoFollow {
+		return false
+	}
+	if l.URL.Scheme != "http" && l.URL.Scheme != "https" {
+		return false
+	}
+	switch l.Kind {
+	case "a", "area", "iframe", "frame", "meta":
+		return true
+	}
+	return false
+}
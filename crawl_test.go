@@ -0,0 +1,324 @@
+package crawl_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"xojoc.pw/crawl"
+	"xojoc.pw/crawl/httpcache"
+	"xojoc.pw/crawl/robots"
+)
+
+func site() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="a">a</a> <a href="/b#x">b</a> <a href="/private/c">c</a> <a href="mailto:x@y">m</a>`)
+		case "/a":
+			fmt.Fprint(w, `<a href="/">home</a> <a href="/b">b</a>`)
+		case "/b":
+			fmt.Fprint(w, `<p>leaf</p>`)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestCrawler_Run(t *testing.T) {
+	ts := site()
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var got []string
+	c := &crawl.Crawler{
+		Seeds:   []string{ts.URL + "/"},
+		Workers: 3,
+		Handle: func(p *crawl.Page) error {
+			mu.Lock()
+			got = append(got, p.URL.Path)
+			mu.Unlock()
+			return p.Err
+		},
+	}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	want := fmt.Sprint([]string{"/", "/a", "/b"})
+	if fmt.Sprint(got) != want {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
+
+func TestCrawler_RunCancel(t *testing.T) {
+	ts := site()
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &crawl.Crawler{
+		Seeds: []string{ts.URL + "/"},
+		Handle: func(p *crawl.Page) error {
+			cancel()
+			return nil
+		},
+	}
+	if err := c.Run(ctx); err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestCrawler_RunScope(t *testing.T) {
+	ts := site()
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var got []string
+	rejected := map[string]string{}
+	c := &crawl.Crawler{
+		Seeds: []string{ts.URL + "/"},
+		Scope: crawl.And(crawl.SameHost(), crawl.MaxDepth(1), crawl.Exclude(regexp.MustCompile(`/b$`))),
+		Handle: func(p *crawl.Page) error {
+			mu.Lock()
+			got = append(got, p.URL.Path)
+			mu.Unlock()
+			return p.Err
+		},
+		Rejected: func(e *crawl.Entry, why error) {
+			mu.Lock()
+			rejected[e.URL.Path] = why.Error()
+			mu.Unlock()
+		},
+	}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint([]string{"/", "/a"}) {
+		t.Errorf("got %s", got)
+	}
+	if len(rejected) != 2 || rejected["/b"] == "" || rejected["/private/c"] != crawl.ErrDisallowed.Error() {
+		t.Errorf("rejected %v", rejected)
+	}
+}
+
+func TestCrawler_RunOriginalURL(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `<a href="/q?b=2&a=1">1</a> <a href="/q?a=1&b=2">2</a>`)
+			return
+		}
+		if r.URL.Path != "/q" {
+			http.NotFound(w, r)
+			return
+		}
+		mu.Lock()
+		got = append(got, r.URL.RequestURI())
+		mu.Unlock()
+	}))
+	defer ts.Close()
+
+	c := &crawl.Crawler{Seeds: []string{ts.URL + "/"}}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// fetched once, as linked
+	if fmt.Sprint(got) != "[/q?b=2&a=1]" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestCrawler_RunRobotsUnreachable(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		t.Errorf("%s fetched", r.URL)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "crawl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := crawl.OpenFrontier(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c := &crawl.Crawler{
+		Seeds:    []string{ts.URL + "/"},
+		Frontier: f,
+		Rejected: func(e *crawl.Entry, why error) {
+			t.Errorf("%s rejected: %v", e.URL, why)
+		},
+	}
+	if err := c.Run(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+	es, err := f.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 1 || es[0].URL.String() != ts.URL+"/" {
+		t.Errorf("want the seed pending, got %v", es)
+	}
+}
+
+func TestCrawler_RunRobotsFetch(t *testing.T) {
+	var hits int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			// redirects forever
+			n := atomic.AddInt32(&hits, 1)
+			http.Redirect(w, r, fmt.Sprintf("/robots.txt?%d", n), http.StatusFound)
+			return
+		}
+		fmt.Fprint(w, "page")
+	}))
+	defer ts.Close()
+
+	cache := httpcache.NewMemoryCache()
+	var got []string
+	c := &crawl.Crawler{
+		Seeds: []string{ts.URL + "/"},
+		Cache: cache,
+		Handle: func(p *crawl.Page) error {
+			got = append(got, p.URL.Path)
+			return p.Err
+		},
+	}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(got) != "[/]" {
+		t.Errorf("got %s", got)
+	}
+	if n := atomic.LoadInt32(&hits); n != robots.MaxRedirects+1 {
+		t.Errorf("want %d fetches of robots.txt, got %d", robots.MaxRedirects+1, n)
+	}
+	if ok, _ := cache.Has(context.Background(), ts.URL+"/robots.txt"); ok {
+		t.Error("robots.txt cached")
+	}
+}
+
+func TestCrawler_RunVisitTime(t *testing.T) {
+	// a window that starts in two hours
+	now := time.Now().UTC()
+	from, to := now.Add(2*time.Hour), now.Add(3*time.Hour)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			fmt.Fprintf(w, "User-agent: *\nVisit-time: %s-%s\n", from.Format("1504"), to.Format("1504"))
+			return
+		}
+		t.Errorf("%s fetched outside of Visit-time", r.URL)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	c := &crawl.Crawler{Seeds: []string{ts.URL + "/"}}
+	if err := c.Run(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestCrawler_RunSlowRobots(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/robots.txt" {
+			<-release
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer fast.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	c := &crawl.Crawler{
+		Seeds:   []string{slow.URL + "/", fast.URL + "/"},
+		Workers: 2,
+		Handle: func(p *crawl.Page) error {
+			if p.URL.Host == fast.Listener.Addr().String() {
+				close(done)
+			}
+			return nil
+		},
+	}
+	go c.Run(ctx)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("a slow robots.txt holds the other hosts")
+	}
+}
+
+func TestCrawler_RunRedirect(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/dir":
+			http.Redirect(w, r, "/dir/", http.StatusMovedPermanently)
+		case "/dir/":
+			fmt.Fprint(w, `<a href="x">x</a>`)
+		case "/dir/x":
+			http.Redirect(w, r, "/private/y", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	for _, fetch := range []crawl.FetchFunc{nil, http.DefaultClient.Do} {
+		got = nil
+		c := &crawl.Crawler{
+			Seeds: []string{ts.URL + "/dir"},
+			Fetch: fetch,
+			Scope: crawl.Exclude(regexp.MustCompile(`/private/`)),
+		}
+		if err := c.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		want := "[/dir /dir/ /dir/x /robots.txt]"
+		if fetch != nil {
+			// the client follows the redirects, but the links are
+			// relative to the final URL
+			want = "[/dir /dir/ /dir/x /private/y /robots.txt]"
+		}
+		if fmt.Sprint(got) != want {
+			t.Errorf("want %s, got %s", want, got)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package crawl
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"xojoc.pw/crawl/urlnorm"
+)
+
+// State is the state of an entry in a Frontier.
+type State int
+
+const (
+	Queued State = iota
+	InFlight
+	Completed
+	Rejected
+)
+
+// Frontier records every URL known to a crawl and its state.
+type Frontier interface {
+	// Add records e as queued. It returns false if e.URL is already known,
+	// comparing URLs normalized with urlnorm.Default.
+	Add(e *Entry) (bool, error)
+	// Start marks e as in flight.
+	Start(e *Entry) error
+	// Complete marks e as completed.
+	Complete(e *Entry) error
+	// Reject records e as not crawled and why. If e was not known it is
+	// added.
+	Reject(e *Entry, why error) error
+	// Pending returns the entries that are queued or in flight, in the
+	// order they were added.
+	Pending() ([]*Entry, error)
+	Close() error
+}
+
+type record struct {
+	Op  string `json:"op"`
+	URL string `json:"url"`
+	// Orig is the URL as found, if not the same as the normalized URL.
+	Orig   string `json:"orig,omitempty"`
+	Depth  int    `json:"depth,omitempty"`
+	Source string `json:"source,omitempty"`
+	Seed   string `json:"seed,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	state State
+	seq   int
+}
+
+// memFrontier keeps the state only in memory.
+type memFrontier struct {
+	mu      sync.Mutex
+	records map[string]*record
+	seq     int
+}
+
+func newMemFrontier() *memFrontier {
+	return &memFrontier{records: map[string]*record{}}
+}
+
+// key returns the normalized URL of e, which identifies e in the frontier.
+func key(e *Entry) string {
+	return urlnorm.Normalize(e.URL, urlnorm.Default).String()
+}
+
+func (f *memFrontier) add(r *record) bool {
+	if _, ok := f.records[r.URL]; ok {
+		return false
+	}
+	f.seq++
+	r.seq = f.seq
+	f.records[r.URL] = r
+	return true
+}
+
+func (f *memFrontier) set(u string, s State) {
+	if r, ok := f.records[u]; ok {
+		r.state = s
+	}
+}
+
+func (f *memFrontier) reject(r *record) {
+	f.add(&record{URL: r.URL, Orig: r.Orig, Depth: r.Depth, Source: r.Source, Seed: r.Seed})
+	f.records[r.URL].state = Rejected
+	f.records[r.URL].Reason = r.Reason
+}
+
+func newRecord(op string, e *Entry) *record {
+	r := &record{Op: op, URL: key(e), Depth: e.Depth, Source: e.Source, Seed: e.Seed}
+	if u := e.URL.String(); u != r.URL {
+		r.Orig = u
+	}
+	return r
+}
+
+func (r *record) entry() (*Entry, error) {
+	raw := r.URL
+	if r.Orig != "" {
+		raw = r.Orig
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{URL: u, Depth: r.Depth, Source: r.Source, Seed: r.Seed}, nil
+}
+
+func (f *memFrontier) Add(e *Entry) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.add(newRecord("add", e)), nil
+}
+
+func (f *memFrontier) Start(e *Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(key(e), InFlight)
+	return nil
+}
+
+func (f *memFrontier) Complete(e *Entry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.set(key(e), Completed)
+	return nil
+}
+
+func (f *memFrontier) Reject(e *Entry, why error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	r := newRecord("reject", e)
+	r.Reason = why.Error()
+	f.reject(r)
+	return nil
+}
+
+func (f *memFrontier) Pending() ([]*Entry, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rs []*record
+	for _, r := range f.records {
+		if r.state == Queued || r.state == InFlight {
+			rs = append(rs, r)
+		}
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].seq < rs[j].seq })
+	var es []*Entry
+	for _, r := range rs {
+		e, err := r.entry()
+		if err != nil {
+			continue
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
+
+func (f *memFrontier) Close() error {
+	return nil
+}
+
+// DiskFrontier is a Frontier that survives restarts. Every change is
+// appended to a journal which is periodically folded into a checkpoint.
+// When reopened, entries that were in flight are queued again.
+type DiskFrontier struct {
+	// CheckpointEvery is the number of journal records after which a
+	// checkpoint is written. Zero means 10000.
+	CheckpointEvery int
+
+	dir     string
+	mem     *memFrontier
+	journal *os.File
+	w       *bufio.Writer
+	n       int
+}
+
+// OpenFrontier opens or creates the DiskFrontier stored in dir.
+func OpenFrontier(dir string) (*DiskFrontier, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f := &DiskFrontier{dir: dir, mem: newMemFrontier()}
+	for _, name := range []string{"checkpoint", "journal"} {
+		err = f.load(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, r := range f.mem.records {
+		if r.state == InFlight {
+			r.state = Queued
+		}
+	}
+	// start from a fresh journal
+	err = f.Checkpoint()
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// load replays the records in file p. A truncated last line, left by a
+// crash, is ignored.
+func (f *DiskFrontier) load(p string) error {
+	fd, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	buf := bufio.NewReader(fd)
+	for {
+		l, err := buf.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		r := &record{}
+		if json.Unmarshal(l, r) != nil {
+			continue
+		}
+		f.apply(r)
+	}
+}
+
+func (f *DiskFrontier) apply(r *record) bool {
+	switch r.Op {
+	case "add":
+		return f.mem.add(r)
+	case "start":
+		f.mem.set(r.URL, InFlight)
+	case "complete":
+		f.mem.set(r.URL, Completed)
+	case "reject":
+		f.mem.reject(r)
+	}
+	return true
+}
+
+func (f *DiskFrontier) log(r *record) (bool, error) {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	if !f.apply(r) {
+		return false, nil
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	_, err = f.w.Write(append(b, '\n'))
+	if err == nil {
+		err = f.w.Flush()
+	}
+	if err != nil {
+		return false, err
+	}
+	f.n++
+	every := f.CheckpointEvery
+	if every <= 0 {
+		every = 10000
+	}
+	if f.n >= every {
+		return true, f.checkpoint()
+	}
+	return true, nil
+}
+
+func (f *DiskFrontier) Add(e *Entry) (bool, error) {
+	return f.log(newRecord("add", e))
+}
+
+func (f *DiskFrontier) Start(e *Entry) error {
+	_, err := f.log(&record{Op: "start", URL: key(e)})
+	return err
+}
+
+func (f *DiskFrontier) Complete(e *Entry) error {
+	_, err := f.log(&record{Op: "complete", URL: key(e)})
+	return err
+}
+
+func (f *DiskFrontier) Reject(e *Entry, why error) error {
+	r := newRecord("reject", e)
+	r.Reason = why.Error()
+	_, err := f.log(r)
+	return err
+}
+
+func (f *DiskFrontier) Pending() ([]*Entry, error) {
+	return f.mem.Pending()
+}
+
+// Checkpoint writes the state of every entry to disk and empties the
+// journal.
+func (f *DiskFrontier) Checkpoint() error {
+	f.mem.mu.Lock()
+	defer f.mem.mu.Unlock()
+	return f.checkpoint()
+}
+
+func (f *DiskFrontier) checkpoint() error {
+	rs := make([]*record, 0, len(f.mem.records))
+	for _, r := range f.mem.records {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].seq < rs[j].seq })
+
+	p := filepath.Join(f.dir, "checkpoint")
+	tmp, err := os.Create(p + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, r := range rs {
+		// one add record followed by the state
+		c := *r
+		c.Op = "add"
+		c.Reason = ""
+		err = enc.Encode(&c)
+		switch {
+		case err != nil:
+		case r.state == InFlight:
+			err = enc.Encode(&record{Op: "start", URL: r.URL})
+		case r.state == Completed:
+			err = enc.Encode(&record{Op: "complete", URL: r.URL})
+		case r.state == Rejected:
+			err = enc.Encode(&record{Op: "reject", URL: r.URL, Reason: r.Reason})
+		}
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Rename(p+".tmp", p)
+	if err != nil {
+		return err
+	}
+
+	if f.journal != nil {
+		f.journal.Close()
+	}
+	f.journal, err = os.Create(filepath.Join(f.dir, "journal"))
+	if err != nil {
+		return err
+	}
+	f.w = bufio.NewWriter(f.journal)
+	f.n = 0
+	return nil
+}
+
+// Close writes a checkpoint and closes the journal.
+func (f *DiskFrontier) Close() error {
+	err := f.Checkpoint()
+	if cerr := f.journal.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package crawl_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"xojoc.pw/crawl"
+)
+
+func TestDiskFrontier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "frontier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := crawl.OpenFrontier(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := entry("http://a/"), entry("http://a/b"), entry("http://a/c")
+	b.Depth, b.Source = 1, "http://a/"
+	for _, e := range []*crawl.Entry{a, b, c, a} {
+		if _, err := f.Add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Start(a)
+	f.Complete(a)
+	f.Start(b)
+	f.Reject(entry("http://a/d"), crawl.ErrDisallowed)
+	// simulate a crash: don't close f, and leave half a record behind
+	fd, err := os.OpenFile(filepath.Join(dir, "journal"), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString(`{"op":"complete","url":"http://a/`)
+	fd.Close()
+
+	f, err = crawl.OpenFrontier(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	es, err := f.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(es) != 2 {
+		t.Fatalf("want 2 pending entries, got %d", len(es))
+	}
+	if es[0].URL.String() != "http://a/b" || es[0].Depth != 1 || es[0].Source != "http://a/" {
+		t.Errorf("bad entry %+v", es[0])
+	}
+	if es[1].URL.String() != "http://a/c" {
+		t.Errorf("want http://a/c, got %s", es[1].URL)
+	}
+	if ok, _ := f.Add(a); ok {
+		t.Errorf("completed entry %s added again", a.URL)
+	}
+	if ok, _ := f.Add(entry("http://a/d")); ok {
+		t.Errorf("rejected entry added again")
+	}
+}
@@ -0,0 +1,180 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package html
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Link is a reference from a page to another resource.
+type Link struct {
+	URL *url.URL
+	// Kind is the name of the element the link comes from: a, area, link,
+	// img, script, iframe, frame, form, source, meta, ...
+	Kind string
+	Rel  string
+	// Text is the anchor text, or the alt text of images and areas.
+	Text string
+	// NoFollow is true if the link has rel="nofollow" or the page has
+	// <meta name="robots" content="nofollow">.
+	NoFollow bool
+}
+
+// linkAttrs are the attributes holding URLs for each element.
+var linkAttrs = map[string][]string{
+	"a":      {"href"},
+	"area":   {"href"},
+	"link":   {"href"},
+	"img":    {"src", "srcset"},
+	"script": {"src"},
+	"iframe": {"src"},
+	"frame":  {"src"},
+	"embed":  {"src"},
+	"video":  {"src", "poster"},
+	"audio":  {"src"},
+	"source": {"src", "srcset"},
+	"track":  {"src"},
+	"form":   {"action"},
+}
+
+// Links returns every outbound reference of the document n, resolved
+// against the document's <base href> and pageURL.
+func (n *Node) Links(pageURL *url.URL) []*Link {
+	if n == nil || n.node == nil {
+		return nil
+	}
+	base := pageURL
+	nofollow := false
+	for _, b := range n.Elements("base") {
+		if href := strings.TrimSpace(b.Attr("href")); href != "" {
+			if u, err := pageURL.Parse(href); err == nil {
+				base = u
+			}
+			break
+		}
+	}
+	for _, m := range n.Elements("meta") {
+		if strings.EqualFold(m.Attr("name"), "robots") && hasToken(m.Attr("content"), "nofollow", "none") {
+			nofollow = true
+		}
+	}
+
+	var links []*Link
+	add := func(e *Node, ref string) {
+		ref = strings.TrimSpace(ref)
+		if ref == "" {
+			return
+		}
+		u, err := base.Parse(ref)
+		if err != nil {
+			return
+		}
+		l := &Link{
+			URL:  u,
+			Kind: e.node.Data,
+			Rel:  e.Attr("rel"),
+		}
+		l.NoFollow = nofollow || hasToken(l.Rel, "nofollow")
+		switch l.Kind {
+		case "a":
+			l.Text = strings.Join(strings.Fields(e.PlainText()), " ")
+			if l.Text == "" {
+				if img := e.Elements("img"); len(img) > 0 {
+					l.Text = img[0].Attr("alt")
+				}
+			}
+		case "area", "img":
+			l.Text = e.Attr("alt")
+		}
+		links = append(links, l)
+	}
+
+	n.Elements2(func(e *Node) {
+		name := e.node.Data
+		if name == "meta" {
+			if strings.EqualFold(e.Attr("http-equiv"), "refresh") {
+				if ref, ok := refreshURL(e.Attr("content")); ok {
+					add(e, ref)
+				}
+			}
+			return
+		}
+		for _, attr := range linkAttrs[name] {
+			v := e.Attr(attr)
+			if attr == "srcset" {
+				for _, ref := range srcset(v) {
+					add(e, ref)
+				}
+				continue
+			}
+			add(e, v)
+		}
+	}, "a", "area", "link", "img", "script", "iframe", "frame", "embed",
+		"video", "audio", "source", "track", "form", "meta")
+
+	return links
+}
+
+func hasToken(s string, tokens ...string) bool {
+	for _, f := range strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	}) {
+		for _, t := range tokens {
+			if f == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// srcset returns the URLs of a srcset attribute like "a.png 1x, b.png 2x".
+func srcset(s string) []string {
+	var refs []string
+	for _, c := range strings.Split(s, ",") {
+		fs := strings.Fields(c)
+		if len(fs) > 0 {
+			refs = append(refs, fs[0])
+		}
+	}
+	return refs
+}
+
+// refreshURL returns the URL of a meta refresh content like "5; url=/next".
+func refreshURL(content string) (string, bool) {
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return "", false
+	}
+	s := strings.TrimSpace(content[i+1:])
+	if len(s) < 3 || !strings.EqualFold(s[:3], "url") {
+		return "", false
+	}
+	s = strings.TrimSpace(s[3:])
+	if !strings.HasPrefix(s, "=") {
+		return "", false
+	}
+	s = strings.TrimSpace(s[1:])
+	if len(s) > 1 && (s[0] == '\'' || s[0] == '"') {
+		if j := strings.IndexByte(s[1:], s[0]); j >= 0 {
+			s = s[1 : j+1]
+		} else {
+			s = s[1:]
+		}
+	}
+	return s, s != ""
+}
@@ -0,0 +1,55 @@
+package html_test
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"xojoc.pw/crawl/html"
+)
+
+func TestNode_Links(t *testing.T) {
+	doc, err := html.Parse(strings.NewReader(`<html><head>
+<base href="/dir/">
+<meta http-equiv="refresh" content="5; URL='next.html'">
+<link rel="stylesheet" href="s.css">
+<script src="//cdn.example.org/x.js"></script>
+</head><body>
+<a href="a.html">The  A
+page</a>
+<a href="/b#top" rel="nofollow noopener"><img src="b.png" srcset="b1.png 1x, b2.png 2x" alt="B"></a>
+<area href="http://other.org/" alt="other">
+<form action="?q=1"></form>
+<iframe src="frame.html"></iframe>
+<a href="">empty</a>
+</body></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := url.Parse("http://example.org/x/page.html")
+	var got [][]string
+	for _, l := range doc.Links(page) {
+		nf := ""
+		if l.NoFollow {
+			nf = "nofollow"
+		}
+		got = append(got, []string{l.Kind, l.URL.String(), l.Rel, l.Text, nf})
+	}
+	want := [][]string{
+		{"meta", "http://example.org/dir/next.html", "", "", ""},
+		{"link", "http://example.org/dir/s.css", "stylesheet", "", ""},
+		{"script", "http://cdn.example.org/x.js", "", "", ""},
+		{"a", "http://example.org/dir/a.html", "", "The A page", ""},
+		{"a", "http://example.org/b#top", "nofollow noopener", "B", "nofollow"},
+		{"img", "http://example.org/dir/b.png", "", "B", ""},
+		{"img", "http://example.org/dir/b1.png", "", "B", ""},
+		{"img", "http://example.org/dir/b2.png", "", "B", ""},
+		{"area", "http://other.org/", "", "other", ""},
+		{"form", "http://example.org/dir/?q=1", "", "", ""},
+		{"iframe", "http://example.org/dir/frame.html", "", "", ""},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("# want:\n%q\n\n# got:\n%q\n", want, got)
+	}
+}
@@ -0,0 +1,170 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// With Dedup set, bodies are stored once under blobs/, named by their
+// SHA-256, and entries keep only the headers and the name of the blob in
+// headerBlob. The index counts the references to each blob and a blob is
+// removed with its last entry.
+const headerBlob = "X-Cache-Blob"
+
+// blob is a body referenced by refs entries.
+type blob struct {
+	size int64
+	refs int
+}
+
+func (d *DiskCache) blobPath(sum string) string {
+	return path.Join("blobs", sum[:2], sum[2:])
+}
+
+// acquireBlob references the blob sum, storing body compressed with c if it
+// is new.
+func (d *DiskCache) acquireBlob(sum string, body []byte, c Compression) error {
+	x := &d.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	err := d.loadIndex()
+	if err != nil {
+		return err
+	}
+	if b, ok := x.blobs[sum]; ok {
+		b.refs++
+		return nil
+	}
+	b, err := compress(body, c)
+	if err != nil {
+		return err
+	}
+	err = d.writeFile(d.blobPath(sum), b)
+	if err != nil {
+		return err
+	}
+	x.blobs[sum] = &blob{size: int64(len(b)), refs: 1}
+	x.size += int64(len(b))
+	return nil
+}
+
+// releaseBlob drops a reference to the blob sum and removes it when
+// unreferenced. It must be called with d.index.mu held.
+func (d *DiskCache) releaseBlob(sum string) error {
+	x := &d.index
+	b, ok := x.blobs[sum]
+	if sum == "" || !ok {
+		return nil
+	}
+	b.refs--
+	if b.refs > 0 {
+		return nil
+	}
+	delete(x.blobs, sum)
+	x.size -= b.size
+	return d.removeFile(d.blobPath(sum))
+}
+
+// unlinkBlob is releaseBlob for callers not holding d.index.mu.
+func (d *DiskCache) unlinkBlob(sum string) {
+	x := &d.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	d.releaseBlob(sum)
+}
+
+// readBlob replaces the body of r with its blob, if it has one. A missing
+// blob, released by a concurrent Put, is reported as ErrNotFound.
+func (d *DiskCache) readBlob(r *http.Response) error {
+	sum := r.Header.Get(headerBlob)
+	if sum == "" {
+		return nil
+	}
+	if len(sum) != 64 {
+		return errFormat
+	}
+	b, err := d.readFile(d.blobPath(sum))
+	if err != nil {
+		return err
+	}
+	b, err = decode(b)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	r.ContentLength = int64(len(b))
+	// the one of the stub without body
+	r.Header.Set("Content-Length", strconv.Itoa(len(b)))
+	r.Header.Del(headerBlob)
+	return nil
+}
+
+// entryBlob returns the blob referenced by the entry at path p, if any.
+func (d *DiskCache) entryBlob(p string) string {
+	b, err := d.readFile(p)
+	if err != nil {
+		return ""
+	}
+	b, err = decode(b)
+	if err != nil {
+		return ""
+	}
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return ""
+	}
+	return r.Header.Get(headerBlob)
+}
+
+// Duplicates returns the groups of URLs stored with the same body, whether
+// Dedup is set or not. Entries without metadata are ignored.
+func (d *DiskCache) Duplicates(ctx context.Context) ([][]string, error) {
+	byHash := map[string][]string{}
+	err := d.walk(func(p string, fi Info) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m, err := d.readMeta(p)
+		if err != nil {
+			return nil
+		}
+		byHash[m.ContentHash] = append(byHash[m.ContentHash], m.URL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups [][]string
+	for _, us := range byHash {
+		if len(us) > 1 {
+			sort.Strings(us)
+			groups = append(groups, us)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i][0] < groups[j][0]
+	})
+	return groups, nil
+}
@@ -0,0 +1,519 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Policy chooses which entries are evicted first.
+type Policy int
+
+const (
+	// LRU evicts the least recently used entries.
+	LRU Policy = iota
+	// LFU evicts the least frequently used entries.
+	LFU
+)
+
+// indexEntry records the size and use of an entry.
+type indexEntry struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	Atime time.Time `json:"atime"`
+	Hits  int64     `json:"hits"`
+	// Blob is the body referenced by the entry and BlobSize its size.
+	Blob     string `json:"blob,omitempty"`
+	BlobSize int64  `json:"blob_size,omitempty"`
+	// Deleted is set in the journal when the entry is removed.
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// index keeps track of the entries of a DiskCache.
+//
+// If the Storage implements Sidecars, the index is saved in the file
+// "index" and each change is appended to the file "index.journal", which
+// is folded into "index" once it is as long as it. The journal exists
+// while the cache is in use: if it is found on load, the cache was not
+// closed and the index is reconciled with the Storage, which may have
+// entries never journaled. Otherwise the index is rebuilt walking the
+// Storage.
+type index struct {
+	mu      sync.Mutex
+	loaded  bool
+	entries map[string]*indexEntry
+	blobs   map[string]*blob
+	size    int64
+	journal *os.File
+	w       *bufio.Writer
+	// changes is the number of records in the journal.
+	changes int
+}
+
+// saveEvery is the minimum number of changes after which the journal is
+// folded into the index.
+const saveEvery = 1000
+
+func (d *DiskCache) indexPath() string {
+	return "index"
+}
+
+func (d *DiskCache) journalPath() string {
+	return "index.journal"
+}
+
+// sidecar returns the local path of the file name kept next to the
+// Storage, or "" if the Storage doesn't implement Sidecars.
+func (d *DiskCache) sidecar(name string) string {
+	if s, ok := d.storage().(Sidecars); ok {
+		return s.SidecarPath(name)
+	}
+	return ""
+}
+
+// readIndex reads the entries of the index file p, then replays the
+// journal. It returns false if the index can't be trusted.
+func readIndex(p, journal string) (map[string]*indexEntry, bool, error) {
+	es := map[string]*indexEntry{}
+	clean := true
+	for _, f := range []string{p, journal} {
+		b, err := ioutil.ReadFile(f)
+		if os.IsNotExist(err) {
+			// no index, or a clean one
+			clean = clean && f == journal
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if f == journal {
+			clean = false
+		}
+		s := bufio.NewScanner(bytes.NewReader(b))
+		s.Buffer(nil, 1<<20)
+		for s.Scan() {
+			e := &indexEntry{}
+			if json.Unmarshal(s.Bytes(), e) != nil {
+				continue
+			}
+			if e.Deleted {
+				delete(es, e.Name)
+				continue
+			}
+			es[e.Name] = e
+		}
+	}
+	return es, clean, nil
+}
+
+// loadIndex reads the index from disk, reconciling it with the Storage if
+// needed, and starts the journal. It must be called with d.index.mu held.
+func (d *DiskCache) loadIndex() error {
+	x := &d.index
+	if x.loaded {
+		return nil
+	}
+	x.entries = map[string]*indexEntry{}
+	x.blobs = map[string]*blob{}
+	x.size = 0
+	p := d.sidecar(d.indexPath())
+	if p == "" {
+		err := d.reconcile(nil)
+		if err != nil {
+			return err
+		}
+		x.loaded = true
+		return nil
+	}
+	es, clean, err := readIndex(p, d.sidecar(d.journalPath()))
+	if err != nil {
+		return err
+	}
+	if clean {
+		for _, e := range es {
+			d.load(e)
+		}
+	} else {
+		err = d.reconcile(es)
+		if err != nil {
+			return err
+		}
+	}
+	x.loaded = true
+	if !clean {
+		return d.saveIndex()
+	}
+	return d.openJournal(false)
+}
+
+// reconcile loads the entries found in the Storage, taking their use from
+// es, and removes the blobs no entry references. It must be called with
+// d.index.mu held.
+func (d *DiskCache) reconcile(es map[string]*indexEntry) error {
+	var blobs []Info
+	err := d.storage().Walk(func(fi Info) error {
+		if strings.HasPrefix(fi.Name, "blobs/") {
+			blobs = append(blobs, fi)
+			return nil
+		}
+		if !isEntry(fi.Name) {
+			return nil
+		}
+		e, ok := es[fi.Name]
+		if !ok {
+			// never journaled
+			e = &indexEntry{Name: fi.Name, Atime: fi.ModTime}
+		}
+		e.Size = fi.Size
+		e.Blob = d.entryBlob(fi.Name)
+		e.BlobSize = 0
+		if e.Blob != "" {
+			if bi, err := d.storage().Stat(d.blobPath(e.Blob)); err == nil {
+				e.BlobSize = bi.Size
+			}
+		}
+		d.load(e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, fi := range blobs {
+		sum := strings.Replace(strings.TrimPrefix(fi.Name, "blobs/"), "/", "", 1)
+		if _, ok := d.index.blobs[sum]; !ok {
+			// left by a crash before its entry was written
+			err = d.removeFile(fi.Name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// openJournal opens the journal, emptying it if truncate. It must be
+// called with d.index.mu held.
+func (d *DiskCache) openJournal(truncate bool) error {
+	x := &d.index
+	p := d.sidecar(d.journalPath())
+	if p == "" {
+		return nil
+	}
+	if x.journal != nil {
+		x.journal.Close()
+		x.journal = nil
+	}
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if truncate {
+		flag |= os.O_TRUNC
+	}
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		return err
+	}
+	x.journal, x.w = f, bufio.NewWriter(f)
+	if truncate {
+		x.changes = 0
+	}
+	return nil
+}
+
+// openIndex loads the index if needed.
+func (d *DiskCache) openIndex() error {
+	x := &d.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return d.loadIndex()
+}
+
+// load adds e to the index. It must be called with d.index.mu held.
+func (d *DiskCache) load(e *indexEntry) {
+	x := &d.index
+	x.entries[e.Name] = e
+	x.size += e.Size
+	if e.Blob == "" {
+		return
+	}
+	b, ok := x.blobs[e.Blob]
+	if !ok {
+		b = &blob{size: e.BlobSize}
+		x.blobs[e.Blob] = b
+		x.size += b.size
+	}
+	b.refs++
+}
+
+// walk calls fn for each entry in the shard directories.
+func (d *DiskCache) walk(fn func(p string, fi Info) error) error {
+	return d.storage().Walk(func(fi Info) error {
+		if !isEntry(fi.Name) {
+			return nil
+		}
+		return fn(fi.Name, fi)
+	})
+}
+
+// isEntry reports whether the file name is an entry: a file in a shard
+// directory, like "ab/cdef", but not its metadata.
+func isEntry(name string) bool {
+	dir, file := path.Split(name)
+	if len(dir) != 3 || !isHex(dir[0]) || !isHex(dir[1]) {
+		return false
+	}
+	return file != "" && file[0] != '.' && !isMeta(file)
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f'
+}
+
+// saveIndex writes the index to disk and empties the journal. It must be
+// called with d.index.mu held.
+func (d *DiskCache) saveIndex() error {
+	x := &d.index
+	p := d.sidecar(d.indexPath())
+	if !x.loaded || p == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range x.entries {
+		err := enc.Encode(e)
+		if err != nil {
+			return err
+		}
+	}
+	err := (&DirStorage{}).Put(p, buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return d.openJournal(true)
+}
+
+// changed appends the new state of e to the journal, folding the journal
+// into the index when it is long enough. It must be called with
+// d.index.mu held.
+func (d *DiskCache) changed(e *indexEntry, deleted bool) error {
+	x := &d.index
+	if x.journal == nil {
+		err := d.openJournal(false)
+		if err != nil || x.journal == nil {
+			return err
+		}
+	}
+	c := *e
+	c.Deleted = deleted
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	_, err = x.w.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	x.changes++
+	if x.changes >= saveEvery && x.changes >= len(x.entries) {
+		return d.saveIndex()
+	}
+	return nil
+}
+
+// touch records an access to the entry at path p.
+func (d *DiskCache) touch(p string) {
+	x := &d.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if d.loadIndex() != nil {
+		return
+	}
+	if e, ok := x.entries[p]; ok {
+		e.Atime = now()
+		e.Hits++
+		d.changed(e, false)
+	}
+}
+
+// added records that the entry at path p now has size bytes and references
+// the blob sum, already acquired, and evicts entries if the cache is too big.
+func (d *DiskCache) added(p string, size int64, sum string) error {
+	x := &d.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	err := d.loadIndex()
+	if err != nil {
+		return err
+	}
+	n := p
+	e, ok := x.entries[n]
+	if !ok {
+		e = &indexEntry{Name: n}
+		x.entries[n] = e
+	}
+	x.size += size - e.Size
+	e.Size = size
+	e.Atime = now()
+	e.Hits++
+	err = d.releaseBlob(e.Blob)
+	if err != nil {
+		return err
+	}
+	e.Blob, e.BlobSize = sum, 0
+	if b, ok := x.blobs[sum]; ok {
+		e.BlobSize = b.size
+	}
+	err = d.changed(e, false)
+	if err != nil {
+		return err
+	}
+	if d.full() {
+		// don't evict what was just stored
+		return d.evict(n)
+	}
+	return nil
+}
+
+// removed records that the entry at path p is gone.
+func (d *DiskCache) removed(p string) {
+	x := &d.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if d.loadIndex() != nil {
+		return
+	}
+	n := p
+	if e, ok := x.entries[n]; ok {
+		x.size -= e.Size
+		delete(x.entries, n)
+		d.releaseBlob(e.Blob)
+		d.changed(e, true)
+	}
+}
+
+func (d *DiskCache) full() bool {
+	x := &d.index
+	return (d.MaxSize > 0 && x.size > d.MaxSize) ||
+		(d.MaxEntries > 0 && len(x.entries) > d.MaxEntries)
+}
+
+// evict removes entries but keep, following Policy, until the cache is
+// within its limits. It must be called with d.index.mu held.
+func (d *DiskCache) evict(keep string) error {
+	x := &d.index
+	if !d.full() {
+		return nil
+	}
+	es := make([]*indexEntry, 0, len(x.entries))
+	for _, e := range x.entries {
+		es = append(es, e)
+	}
+	sort.Slice(es, func(i, j int) bool {
+		if d.Policy == LFU && es[i].Hits != es[j].Hits {
+			return es[i].Hits < es[j].Hits
+		}
+		return es[i].Atime.Before(es[j].Atime)
+	})
+	for _, e := range es {
+		if !d.full() {
+			break
+		}
+		if e.Name == keep {
+			continue
+		}
+		err := d.removeFiles(e.Name)
+		if err != nil {
+			return err
+		}
+		x.size -= e.Size
+		delete(x.entries, e.Name)
+		err = d.releaseBlob(e.Blob)
+		if err != nil {
+			return err
+		}
+		err = d.changed(e, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Evict removes entries until the cache is within MaxSize and MaxEntries.
+func (d *DiskCache) Evict() error {
+	x := &d.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	err := d.loadIndex()
+	if err != nil {
+		return err
+	}
+	return d.evict("")
+}
+
+// Sweep runs Evict every interval until stop is called.
+func (d *DiskCache) Sweep(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				d.Evict()
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// Close saves the index of d and closes its Storage.
+func (d *DiskCache) Close() error {
+	x := &d.index
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var err error
+	if x.journal != nil {
+		err = d.saveIndex()
+		if cerr := x.journal.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			// a clean index
+			err = os.Remove(x.journal.Name())
+		}
+		x.journal = nil
+	}
+	if cerr := d.storage().Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
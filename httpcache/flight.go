@@ -0,0 +1,55 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import "sync"
+
+type call struct {
+	done chan struct{}
+	err  error
+}
+
+// flight runs a function only once for concurrent callers with the same key.
+// The zero value is ready to use.
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do runs fn unless another call for k is in progress, in which case it
+// waits for it and returns its error.
+func (g *flight) do(k string, fn func() error) error {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*call{}
+	}
+	if c, ok := g.calls[k]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.err
+	}
+	c := &call{done: make(chan struct{})}
+	g.calls[k] = c
+	g.mu.Unlock()
+
+	c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, k)
+	g.mu.Unlock()
+	close(c.done)
+	return c.err
+}
@@ -0,0 +1,155 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is the algorithm used to compress the entries of a DiskCache.
+type Compression int
+
+const (
+	// NoCompression stores entries as they are.
+	NoCompression Compression = iota
+	Gzip
+	Zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "identity"
+	case Gzip:
+		return "gzip"
+	case Zstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// An entry is a header line followed by the response in wire format,
+// compressed as the header line says:
+//
+//	HTTPCACHE/1 zstd
+//	HTTP/1.1 200 OK
+//	...
+//
+// Entries written before the format was versioned have no header line and
+// start directly with the response.
+const formatVersion = "HTTPCACHE/1"
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// compression returns the compression used to store r. Responses with a
+// gzipped body are not compressed again.
+func (d *DiskCache) compression(r *http.Response) Compression {
+	if strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return NoCompression
+	}
+	return d.Compression
+}
+
+// compress returns b compressed with c, after the header line.
+func compress(b []byte, c Compression) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", formatVersion, c)
+	switch c {
+	case NoCompression:
+		buf.Write(b)
+	case Gzip:
+		w := gzip.NewWriter(&buf)
+		w.Write(b)
+		err := w.Close()
+		if err != nil {
+			return nil, err
+		}
+	case Zstd:
+		return zstdEncoder.EncodeAll(b, buf.Bytes()), nil
+	default:
+		return nil, fmt.Errorf("httpcache: unknown compression %v", c)
+	}
+	return buf.Bytes(), nil
+}
+
+var errFormat = errors.New("httpcache: bad entry format")
+
+// decode returns the serialized response stored in entry b.
+func decode(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte(formatVersion+" ")) {
+		if bytes.HasPrefix(b, []byte("HTTP/")) {
+			// unversioned entry
+			return b, nil
+		}
+		return nil, errFormat
+	}
+	i := bytes.IndexByte(b, '\n')
+	if i < 0 {
+		return nil, errFormat
+	}
+	c := string(b[len(formatVersion)+1 : i])
+	b = b[i+1:]
+	switch c {
+	case "identity":
+		return b, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case "zstd":
+		return zstdDecoder.DecodeAll(b, nil)
+	}
+	return nil, errFormat
+}
+
+// decodeBody replaces a gzipped body of r with the decoded one, as
+// http.Transport does.
+func decodeBody(r *http.Response) error {
+	if !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	z, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	body, err = ioutil.ReadAll(z)
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Content-Length")
+	r.ContentLength = int64(len(body))
+	r.Uncompressed = true
+	return nil
+}
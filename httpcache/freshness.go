@@ -0,0 +1,227 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// now is replaced by tests.
+var now = time.Now
+
+const (
+	headerRequestTime  = "X-Cache-Request-Time"
+	headerResponseTime = "X-Cache-Response-Time"
+	headerVaried       = "X-Varied-"
+)
+
+// cacheControl holds the directives of a Cache-Control header.
+type cacheControl map[string]string
+
+func parseCacheControl(h http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, l := range h["Cache-Control"] {
+		for _, d := range strings.Split(l, ",") {
+			d = strings.TrimSpace(d)
+			if d == "" {
+				continue
+			}
+			k, v := d, ""
+			if i := strings.IndexByte(d, '='); i >= 0 {
+				k, v = d[:i], strings.Trim(strings.TrimSpace(d[i+1:]), `"`)
+			}
+			cc[strings.ToLower(strings.TrimSpace(k))] = v
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(d string) bool {
+	_, ok := cc[d]
+	return ok
+}
+
+// seconds returns the value of the delta-seconds directive d.
+func (cc cacheControl) seconds(d string) (time.Duration, bool) {
+	v, ok := cc[d]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		// invalid values make the response stale
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+func headerTime(h http.Header, name string) (time.Time, bool) {
+	v := h.Get(name)
+	if v == "" {
+		return time.Time{}, false
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// heuristicStatus are the status codes cacheable by default,
+// RFC 9110 section 15.1.
+var heuristicStatus = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true, 308: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// storable reports whether resp, obtained with req, may be stored.
+// RFC 9111 section 3.
+func storable(req *http.Request, resp *http.Response, shared bool) bool {
+	if req.Method != "GET" {
+		return false
+	}
+	reqcc := parseCacheControl(req.Header)
+	cc := parseCacheControl(resp.Header)
+	if reqcc.has("no-store") || cc.has("no-store") {
+		return false
+	}
+	if shared && cc.has("private") {
+		return false
+	}
+	if strings.TrimSpace(resp.Header.Get("Vary")) == "*" {
+		return false
+	}
+	if shared && req.Header.Get("Authorization") != "" &&
+		!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return false
+	}
+	switch resp.StatusCode {
+	case 206, 304:
+		return false
+	}
+	if resp.Header.Get("Expires") != "" || cc.has("max-age") || cc.has("public") ||
+		(shared && cc.has("s-maxage")) || (!shared && cc.has("private")) {
+		return true
+	}
+	return heuristicStatus[resp.StatusCode]
+}
+
+// lifetime returns the freshness lifetime of a stored response.
+// RFC 9111 section 4.2.1.
+func lifetime(resp *http.Response, shared bool) time.Duration {
+	cc := parseCacheControl(resp.Header)
+	if shared {
+		if d, ok := cc.seconds("s-maxage"); ok {
+			return d
+		}
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	date, ok := headerTime(resp.Header, "Date")
+	if !ok {
+		date, _ = headerTime(resp.Header, headerResponseTime)
+	}
+	if resp.Header.Get("Expires") != "" {
+		exp, ok := headerTime(resp.Header, "Expires")
+		if !ok || exp.Before(date) {
+			return 0
+		}
+		return exp.Sub(date)
+	}
+	// heuristic freshness, section 4.2.2
+	if !heuristicStatus[resp.StatusCode] {
+		return 0
+	}
+	lm, ok := headerTime(resp.Header, "Last-Modified")
+	if !ok || lm.After(date) {
+		return 0
+	}
+	d := date.Sub(lm) / 10
+	if d > 24*time.Hour {
+		d = 24 * time.Hour
+	}
+	return d
+}
+
+// age returns the current age of a stored response.
+// RFC 9111 section 4.2.3.
+func age(resp *http.Response) time.Duration {
+	reqTime, _ := headerTime(resp.Header, headerRequestTime)
+	respTime, ok := headerTime(resp.Header, headerResponseTime)
+	if !ok {
+		return 0
+	}
+	apparent := time.Duration(0)
+	if date, ok := headerTime(resp.Header, "Date"); ok && respTime.After(date) {
+		apparent = respTime.Sub(date)
+	}
+	ageValue := time.Duration(0)
+	if n, err := strconv.ParseInt(resp.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	delay := time.Duration(0)
+	if !reqTime.IsZero() && respTime.After(reqTime) {
+		delay = respTime.Sub(reqTime)
+	}
+	corrected := ageValue + delay
+	if apparent > corrected {
+		corrected = apparent
+	}
+	return corrected + now().Sub(respTime)
+}
+
+// fresh reports whether the stored resp can be used for req without
+// revalidation, section 4.2 and 5.2.1.
+func fresh(req *http.Request, resp *http.Response, shared bool) bool {
+	reqcc := parseCacheControl(req.Header)
+	cc := parseCacheControl(resp.Header)
+	if reqcc.has("no-cache") || cc.has("no-cache") {
+		return false
+	}
+	if strings.Contains(req.Header.Get("Pragma"), "no-cache") && len(req.Header["Cache-Control"]) == 0 {
+		return false
+	}
+	life := lifetime(resp, shared)
+	a := age(resp)
+	if d, ok := reqcc.seconds("max-age"); ok && a > d {
+		return false
+	}
+	if d, ok := reqcc.seconds("min-fresh"); ok {
+		a += d
+	}
+	if a < life {
+		return true
+	}
+	if cc.has("must-revalidate") || (shared && cc.has("proxy-revalidate")) {
+		return false
+	}
+	if v, ok := reqcc["max-stale"]; ok {
+		if v == "" {
+			return true
+		}
+		if d, ok := reqcc.seconds("max-stale"); ok && a-life <= d {
+			return true
+		}
+	}
+	return false
+}
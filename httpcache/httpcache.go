@@ -17,25 +17,29 @@ package httpcache
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/md5"
+	"errors"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
 	"path"
+	"strings"
 	"time"
 
-	"xojoc.pw/must"
+	"xojoc.pw/crawl/urlnorm"
 )
 
-func init() {
-	http.DefaultTransport = &http.Transport{
+// NewHTTPTransport returns an *http.Transport suited for crawling many
+// hosts: connections are not kept alive.
+func NewHTTPTransport() *http.Transport {
+	return &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
 			Timeout:   30 * time.Second,
 			KeepAlive: 30 * time.Second,
-			DualStack: true,
 		}).DialContext,
 		DisableKeepAlives:     true,
 		MaxIdleConns:          100,
@@ -45,13 +49,98 @@ func init() {
 	}
 }
 
+// defaultClient is used by a DiskCache without a Client.
+var defaultClient = &http.Client{
+	Transport: NewHTTPTransport(),
+	Timeout:   5 * time.Second,
+}
+
+// ErrNotFound is returned by Cache.Get when no response is stored for a key.
+var ErrNotFound = errors.New("httpcache: not found")
+
+// Cache stores HTTP responses by key, usually a URL.
 type Cache interface {
-	Fetch(string) (*http.Response, bool)
-	IsCached(string) bool
+	// Get returns the response stored for key, or ErrNotFound.
+	Get(ctx context.Context, key string) (*http.Response, error)
+	// Put stores r for key. The body of r is read and replaced with an
+	// equivalent one, so r can still be used.
+	Put(ctx context.Context, key string, r *http.Response) error
+	// Delete removes the response stored for key, if any.
+	Delete(ctx context.Context, key string) error
+	// Has reports whether a response is stored for key.
+	Has(ctx context.Context, key string) (bool, error)
+}
+
+var (
+	_ Cache = (*DiskCache)(nil)
+	_ Cache = (*MemoryCache)(nil)
+)
+
+// readBody reads the body of r and replaces it with one reading the same
+// bytes.
+func readBody(r *http.Response) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, nil
+}
+
+// serialize returns r in wire format with its whole body.
+func serialize(r *http.Response) ([]byte, error) {
+	body, err := readBody(r)
+	if err != nil {
+		return nil, err
+	}
+	c := *r
+	c.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.ContentLength = int64(len(body))
+	c.TransferEncoding = nil
+	var buf bytes.Buffer
+	err = c.Write(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 type DiskCache struct {
 	Base string
+	// Storage holds the entries. If nil the entries are files under
+	// Base.
+	Storage Storage
+	// Client is used to fetch the responses not in the cache.
+	// If nil a client with a 5 seconds timeout using NewHTTPTransport
+	// is used.
+	Client *http.Client
+
+	// MaxSize is the maximum total size of the entries in bytes and
+	// MaxEntries their maximum number. When one is exceeded entries are
+	// evicted following Policy. Zero means no limit.
+	MaxSize    int64
+	MaxEntries int
+	Policy     Policy
+
+	// TTL is how long new entries are served. Zero means forever.
+	TTL time.Duration
+
+	// Compression is used for new entries. Entries are read whatever
+	// their compression.
+	Compression Compression
+
+	// Dedup stores identical bodies only once, shared by their entries.
+	Dedup bool
+
+	// Mode tells Fetch when to use the network.
+	Mode Mode
+
+	flight flight
+	index  index
 }
 
 func NewDiskCache(path string) *DiskCache {
@@ -60,77 +149,266 @@ func NewDiskCache(path string) *DiskCache {
 	return d
 }
 
+// key returns the cache key of URL u. Equivalent URLs have the same key.
+// The suffix of a variant key, see variantKey, is kept as it is.
+func key(u string) string {
+	u, v := splitKey(u)
+	suffix := ""
+	if v != "" {
+		suffix = variantSep + v
+	}
+	n, err := urlnorm.String(u, urlnorm.Default)
+	if err != nil {
+		return u + suffix
+	}
+	return n + suffix
+}
+
+// md5path returns the name of the entry of URL u.
 func (d *DiskCache) md5path(u string) string {
-	m := fmt.Sprintf("%x", md5.Sum([]byte(u)))
-	// TODO:
-	return d.Base + "/" + m[:2] + "/" + m[2:]
+	m := fmt.Sprintf("%x", md5.Sum([]byte(key(u))))
+	return path.Join(m[:2], m[2:])
+}
+
+// storage returns the Storage of d.
+func (d *DiskCache) storage() Storage {
+	if d.Storage == nil {
+		return &DirStorage{Base: d.Base}
+	}
+	return d.Storage
+}
+
+// readFile returns the content of the file p.
+func (d *DiskCache) readFile(p string) ([]byte, error) {
+	return d.storage().Get(p)
 }
 
-type myBody struct {
-	responseBody io.ReadCloser
-	file         *os.File
+// writeFile atomically replaces the file p with b.
+func (d *DiskCache) writeFile(p string, b []byte) error {
+	return d.storage().Put(p, b)
+}
 
-	closed bool
+// removeFile removes the file p, if any.
+func (d *DiskCache) removeFile(p string) error {
+	return d.storage().Delete(p)
 }
 
-func (b *myBody) Close() error {
-	if b.closed {
-		return nil
+// removeFiles removes the entry p and its metadata.
+func (d *DiskCache) removeFiles(p string) error {
+	err := d.removeFile(p)
+	if err != nil {
+		return err
 	}
-	b.closed = true
+	return d.removeFile(p + metaExt)
+}
 
-	//	berr := b.responseBody.Close()
-	ferr := b.file.Close()
-	if ferr != nil {
-		//		log.Println("ferr: ", ferr)
-		return ferr
+// removeEntry removes the entry p and drops it from the index.
+func (d *DiskCache) removeEntry(p string) error {
+	err := d.removeFiles(p)
+	if err != nil {
+		return err
 	}
-	/*
-		if berr != nil {
-			log.Println("berr: ", berr)
-			return berr
-		}
-	*/
+	d.removed(p)
 	return nil
 }
-func (r *myBody) Read(p []byte) (int, error) {
-	return r.responseBody.Read(p)
+
+// quarantine moves the corrupt entry p out of the way, under quarantine/,
+// so it can be inspected later.
+func (d *DiskCache) quarantine(p string) error {
+	q := "quarantine/" + strings.Replace(p, "/", "", -1)
+	d.removed(p)
+	err := d.storage().Rename(p, q)
+	if err != nil {
+		return d.removeFiles(p)
+	}
+	return d.removeFile(p + metaExt)
 }
 
-func (d *DiskCache) Fetch(u string) (*http.Response, error) {
-	p := d.md5path(u)
-	_, err := os.Stat(p)
-	if err == nil {
-		f := must.Open(p)
-		r, err := http.ReadResponse(bufio.NewReader(f), nil)
-		if r != nil {
-			r.Body = &myBody{
-				responseBody: r.Body,
-				file:         f,
-			}
-			r.Header.Add("X-From-Cache", "true")
-		}
-		return r, err
+// parse decodes a stored response checking that it is complete.
+func parse(b []byte) (*http.Response, error) {
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = readBody(r)
+	if err != nil {
+		return nil, err
 	}
-	// remove
-	http.DefaultClient.Timeout = 5 * time.Second
+	return r, nil
+}
 
-	r, err := http.Get(u)
+// read returns the response stored in the entry p, with the body
+// as it was received.
+func (d *DiskCache) read(p string) (*http.Response, error) {
+	b, err := d.readFile(p)
+	if err != nil {
+		return nil, err
+	}
+	b, err = decode(b)
+	if err != nil {
+		return nil, err
+	}
+	r, err := parse(b)
 	if err != nil {
 		return nil, err
 	}
-	must.OK(os.MkdirAll(path.Dir(p), 0766))
-	w := must.Create(p)
-	defer must.Close(w)
-	err = r.Write(w)
+	err = d.readBlob(r)
 	if err != nil {
 		return nil, err
 	}
-	f := must.Open(p)
-	r, err = http.ReadResponse(bufio.NewReader(f), nil)
-	r.Body = &myBody{
-		responseBody: r.Body,
-		file:         f,
+	return r, nil
+}
+
+// Get returns the response stored for URL key, with the body decoded. A
+// corrupt entry, like one truncated by a crash, is quarantined and reported
+// as ErrNotFound, as are expired entries.
+func (d *DiskCache) Get(ctx context.Context, key string) (*http.Response, error) {
+	return d.get(ctx, key, true)
+}
+
+// Peek is like Get but doesn't count as a use of the entry for eviction.
+func (d *DiskCache) Peek(ctx context.Context, key string) (*http.Response, error) {
+	return d.get(ctx, key, false)
+}
+
+func (d *DiskCache) get(ctx context.Context, key string, touch bool) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	p := d.md5path(key)
+	if d.expired(p) {
+		return nil, ErrNotFound
+	}
+	r, err := d.read(p)
+	if err == nil {
+		err = decodeBody(r)
+	}
+	if err == ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		err = d.quarantine(p)
+		if err != nil {
+			return nil, err
+		}
+		return nil, ErrNotFound
+	}
+	if touch {
+		d.touch(p)
+	}
+	return r, nil
+}
+
+// Put stores r for URL key.
+func (d *DiskCache) Put(ctx context.Context, key string, r *http.Response) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	body, err := readBody(r)
+	if err != nil {
+		return err
+	}
+	// the index must be journaling before an entry is written
+	err = d.openIndex()
+	if err != nil {
+		return err
+	}
+	m := d.newMeta(key, r, body)
+	stored := r
+	sum := ""
+	if d.Dedup {
+		sum = m.ContentHash
+		err = d.acquireBlob(sum, body, d.compression(r))
+		if err != nil {
+			return err
+		}
+		c := *r
+		c.Header = r.Header.Clone()
+		c.Header.Set(headerBlob, sum)
+		c.Body = nil
+		stored = &c
+	}
+	p := d.md5path(key)
+	b, err := serialize(stored)
+	if err == nil {
+		b, err = compress(b, d.compression(r))
+	}
+	if err == nil {
+		err = d.writeFile(p, b)
+	}
+	if err == nil {
+		err = d.writeMeta(p, m)
+	}
+	if err != nil {
+		if sum != "" {
+			d.unlinkBlob(sum)
+		}
+		return err
+	}
+	return d.added(p, int64(len(b)), sum)
+}
+
+// Delete removes the response stored for URL key.
+func (d *DiskCache) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.removeEntry(d.md5path(key))
+}
+
+// Has reports whether a response, not expired, is stored for URL key.
+func (d *DiskCache) Has(ctx context.Context, key string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	p := d.md5path(key)
+	_, err := d.storage().Stat(p)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !d.expired(p), nil
+}
+
+// Fetch returns the response for URL u from the cache, if there, otherwise
+// fetches and stores it, following Mode. Concurrent calls for the same URL
+// make only one request.
+func (d *DiskCache) Fetch(ctx context.Context, u string) (*http.Response, error) {
+	if d.Mode != Refresh {
+		r, err := d.Get(ctx, u)
+		if err == nil {
+			r.Header.Set(headerFromCache, "true")
+			return r, nil
+		}
+		if err != ErrNotFound {
+			return nil, err
+		}
+		if d.Mode == Offline {
+			return nil, ErrNotCached
+		}
+	}
+	err := d.flight.do(key(u), func() error {
+		client := d.Client
+		if client == nil {
+			client = defaultClient
+		}
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return err
+		}
+		reqTime := now()
+		r, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		defer r.Body.Close()
+		setTimes(r.Header, reqTime, now())
+		return d.Put(ctx, u, r)
+	})
+	if err != nil {
+		return nil, err
 	}
-	return r, err
+	return d.Get(ctx, u)
 }
@@ -0,0 +1,361 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// LogStorage keeps all the files in a single append-only log, with an
+// index in memory from names to their last record, like Bitcask. Replaced
+// and deleted files take space until Compact.
+//
+// A record is:
+//
+//	crc32 of the rest (4 bytes)
+//	modification time in Unix nanoseconds (8 bytes)
+//	operation, put or delete (1 byte)
+//	length of the name (4 bytes)
+//	length of the content (4 bytes)
+//	name
+//	content
+//
+// A record truncated by a crash at the end of the log is dropped when the
+// log is opened, any other bad record is an error. Close
+// saves the index in the hint file, the log path plus ".hint", so that the
+// next Open reads only the records appended after it.
+type LogStorage struct {
+	mu    sync.RWMutex
+	path  string
+	f     *os.File
+	size  int64
+	dead  int64
+	index map[string]logEntry
+}
+
+// logEntry locates the last record of a file.
+type logEntry struct {
+	Off     int64     `json:"off"`
+	Len     int64     `json:"len"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+type logHint struct {
+	Size  int64               `json:"size"`
+	Dead  int64               `json:"dead"`
+	Index map[string]logEntry `json:"index"`
+}
+
+const (
+	logHeader = 21
+	logPut    = 0
+	logDelete = 1
+)
+
+var errLogCorrupt = errors.New("httpcache: corrupt log record")
+
+// OpenLogStorage opens, or creates, the log at path.
+func OpenLogStorage(path string) (*LogStorage, error) {
+	s := &LogStorage{path: path}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *LogStorage) open() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.index = map[string]logEntry{}
+	s.size, s.dead = 0, 0
+	if b, err := ioutil.ReadFile(s.hintPath()); err == nil {
+		h := logHint{}
+		if json.Unmarshal(b, &h) == nil && h.Size <= fi.Size() && h.Index != nil {
+			s.index, s.size, s.dead = h.Index, h.Size, h.Dead
+		}
+	}
+	err = s.scan(fi.Size())
+	if err != nil {
+		f.Close()
+	}
+	return err
+}
+
+func (s *LogStorage) hintPath() string {
+	return s.path + ".hint"
+}
+
+// scan reads the records from s.size to end, truncating the log at a
+// record torn at the end.
+func (s *LogStorage) scan(end int64) error {
+	r := bufio.NewReader(io.NewSectionReader(s.f, s.size, end-s.size))
+	for s.size < end {
+		op, name, b, mtime, err := readLogRecord(r, end-s.size)
+		if err == io.ErrUnexpectedEOF {
+			return s.f.Truncate(s.size)
+		}
+		if err != nil {
+			return err
+		}
+		e := logEntry{Off: s.size, Len: int64(logHeader + len(name) + len(b)), Size: int64(len(b)), ModTime: mtime}
+		s.apply(op, name, e)
+		s.size += e.Len
+	}
+	return nil
+}
+
+// apply updates the index after the record e. It must be called with
+// s.mu held.
+func (s *LogStorage) apply(op byte, name string, e logEntry) {
+	if old, ok := s.index[name]; ok {
+		s.dead += old.Len
+	}
+	if op == logDelete {
+		delete(s.index, name)
+		s.dead += e.Len
+		return
+	}
+	s.index[name] = e
+}
+
+// readLogRecord reads a record from r, which has n bytes left. A record
+// longer than n is io.ErrUnexpectedEOF.
+func readLogRecord(r io.Reader, n int64) (op byte, name string, b []byte, mtime time.Time, err error) {
+	var h [logHeader]byte
+	_, err = io.ReadFull(r, h[:])
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return
+	}
+	nlen := binary.BigEndian.Uint32(h[13:17])
+	blen := binary.BigEndian.Uint32(h[17:21])
+	if nlen > 1<<16 {
+		err = errLogCorrupt
+		return
+	}
+	if logHeader+int64(nlen)+int64(blen) > n {
+		err = io.ErrUnexpectedEOF
+		return
+	}
+	rest := make([]byte, int(nlen)+int(blen))
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(h[4:])
+	crc.Write(rest)
+	if crc.Sum32() != binary.BigEndian.Uint32(h[:4]) {
+		err = errLogCorrupt
+		return
+	}
+	op = h[12]
+	mtime = time.Unix(0, int64(binary.BigEndian.Uint64(h[4:12])))
+	return op, string(rest[:nlen]), rest[nlen:], mtime, nil
+}
+
+func logRecord(op byte, name string, b []byte, mtime time.Time) []byte {
+	rec := make([]byte, logHeader+len(name)+len(b))
+	binary.BigEndian.PutUint64(rec[4:12], uint64(mtime.UnixNano()))
+	rec[12] = op
+	binary.BigEndian.PutUint32(rec[13:17], uint32(len(name)))
+	binary.BigEndian.PutUint32(rec[17:21], uint32(len(b)))
+	copy(rec[logHeader:], name)
+	copy(rec[logHeader+len(name):], b)
+	binary.BigEndian.PutUint32(rec[:4], crc32.ChecksumIEEE(rec[4:]))
+	return rec
+}
+
+// append writes a record. It must be called with s.mu held.
+func (s *LogStorage) append(op byte, name string, b []byte) error {
+	mtime := now()
+	rec := logRecord(op, name, b, mtime)
+	n, err := s.f.Write(rec)
+	if err != nil {
+		// don't leave a partial record in the middle of the log
+		s.f.Truncate(s.size)
+		return err
+	}
+	s.apply(op, name, logEntry{Off: s.size, Len: int64(n), Size: int64(len(b)), ModTime: mtime})
+	s.size += int64(n)
+	return nil
+}
+
+func (s *LogStorage) Get(name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.index[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	_, _, b, _, err := readLogRecord(io.NewSectionReader(s.f, e.Off, e.Len), e.Len)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errLogCorrupt
+	}
+	return b, err
+}
+
+func (s *LogStorage) Put(name string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(logPut, name, b)
+}
+
+func (s *LogStorage) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.index[name]; !ok {
+		return nil
+	}
+	return s.append(logDelete, name, nil)
+}
+
+func (s *LogStorage) Rename(from, to string) error {
+	b, err := s.Get(from)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.append(logPut, to, b)
+	if err != nil {
+		return err
+	}
+	return s.append(logDelete, from, nil)
+}
+
+func (s *LogStorage) Stat(name string) (Info, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.index[name]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	return Info{Name: name, Size: e.Size, ModTime: e.ModTime}, nil
+}
+
+func (s *LogStorage) Walk(fn func(Info) error) error {
+	s.mu.RLock()
+	is := make([]Info, 0, len(s.index))
+	for name, e := range s.index {
+		is = append(is, Info{Name: name, Size: e.Size, ModTime: e.ModTime})
+	}
+	s.mu.RUnlock()
+	for _, i := range is {
+		err := fn(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SidecarPath returns the log path plus "." and name.
+func (s *LogStorage) SidecarPath(name string) string {
+	return s.path + "." + name
+}
+
+// Garbage returns the bytes taken by replaced and deleted files.
+func (s *LogStorage) Garbage() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.dead
+}
+
+// Compact rewrites the log with only the current files.
+func (s *LogStorage) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tmp := s.path + ".compact"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for name, e := range s.index {
+		_, _, b, mtime, err := readLogRecord(io.NewSectionReader(s.f, e.Off, e.Len), e.Len)
+		if err == nil {
+			_, err = w.Write(logRecord(logPut, name, b, mtime))
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	err = w.Flush()
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// the hint describes the old log
+		err = os.Remove(s.hintPath())
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.f.Close()
+	return s.open()
+}
+
+// Close saves the hint file and closes the log.
+func (s *LogStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.f.Sync()
+	if err == nil {
+		var b []byte
+		b, err = json.Marshal(logHint{Size: s.size, Dead: s.dead, Index: s.index})
+		if err == nil {
+			err = (&DirStorage{}).Put(s.hintPath(), b)
+		}
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net/http"
+	"sync"
+)
+
+// MemoryCache is a Cache keeping the responses in memory.
+type MemoryCache struct {
+	mu        sync.RWMutex
+	responses map[string][]byte
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{responses: map[string][]byte{}}
+}
+
+func (m *MemoryCache) Get(ctx context.Context, k string) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	b, ok := m.responses[key(k)]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+}
+
+func (m *MemoryCache) Put(ctx context.Context, k string, r *http.Response) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, err := serialize(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.responses[key(k)] = b
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryCache) Delete(ctx context.Context, k string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	delete(m.responses, key(k))
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *MemoryCache) Has(ctx context.Context, k string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	m.mu.RLock()
+	_, ok := m.responses[key(k)]
+	m.mu.RUnlock()
+	return ok, nil
+}
@@ -0,0 +1,228 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Meta describes an entry of a DiskCache. It is stored next to the entry
+// in a file with the .meta extension.
+type Meta struct {
+	// URL is the key the entry was stored with.
+	URL string `json:"url"`
+	// FinalURL is the URL of the response after following redirects and
+	// Redirects the URLs before it, in order.
+	FinalURL  string   `json:"final_url,omitempty"`
+	Redirects []string `json:"redirects,omitempty"`
+	Status    int      `json:"status"`
+
+	FetchedAt time.Time     `json:"fetched_at"`
+	Duration  time.Duration `json:"duration,omitempty"`
+	// Expires is when the entry stops being served. Zero means never.
+	Expires time.Time `json:"expires,omitempty"`
+
+	// RequestHeader has the values of Authorization, Proxy-Authorization
+	// and Cookie replaced with REDACTED.
+	RequestHeader http.Header `json:"request_header,omitempty"`
+	// ContentHash is the hex encoded SHA-256 of the body.
+	ContentHash string `json:"content_hash"`
+	Size        int64  `json:"size"`
+}
+
+const metaExt = ".meta"
+
+// isMeta reports whether the file p is a metadata sidecar.
+func isMeta(p string) bool {
+	return strings.HasSuffix(p, metaExt)
+}
+
+// newMeta describes r, whose body is body, stored for key.
+func (d *DiskCache) newMeta(key string, r *http.Response, body []byte) *Meta {
+	sum := sha256.Sum256(body)
+	m := &Meta{
+		URL:         key,
+		Status:      r.StatusCode,
+		FetchedAt:   now(),
+		ContentHash: hex.EncodeToString(sum[:]),
+		Size:        int64(len(body)),
+	}
+	if t, ok := headerTime(r.Header, headerResponseTime); ok {
+		m.FetchedAt = t
+		if rt, ok := headerTime(r.Header, headerRequestTime); ok {
+			m.Duration = t.Sub(rt)
+		}
+	}
+	if d.TTL > 0 {
+		m.Expires = m.FetchedAt.Add(d.TTL)
+	}
+	if req := r.Request; req != nil {
+		m.FinalURL = req.URL.Redacted()
+		m.RequestHeader = redact(req.Header)
+		for prev := req.Response; prev != nil && prev.Request != nil; prev = prev.Request.Response {
+			m.Redirects = append([]string{prev.Request.URL.Redacted()}, m.Redirects...)
+		}
+	}
+	return m
+}
+
+// credentials are the request headers not stored in Meta.
+var credentials = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// redact returns a copy of h with the values of the credentials replaced.
+func redact(h http.Header) http.Header {
+	h = h.Clone()
+	for _, k := range credentials {
+		if _, ok := h[k]; ok {
+			h[k] = []string{"REDACTED"}
+		}
+	}
+	return h
+}
+
+func (d *DiskCache) readMeta(p string) (*Meta, error) {
+	b, err := d.readFile(p + metaExt)
+	if err != nil {
+		return nil, err
+	}
+	m := &Meta{}
+	err = json.Unmarshal(b, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (d *DiskCache) writeMeta(p string, m *Meta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return d.writeFile(p+metaExt, b)
+}
+
+// expired reports whether the entry at p is past its expiry.
+func (d *DiskCache) expired(p string) bool {
+	m, err := d.readMeta(p)
+	if err != nil {
+		return false
+	}
+	return !m.Expires.IsZero() && now().After(m.Expires)
+}
+
+// Meta returns the metadata of the entry stored for URL key.
+// Entries stored by older versions have no metadata and ErrNotFound is
+// returned.
+func (d *DiskCache) Meta(ctx context.Context, key string) (*Meta, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.readMeta(d.md5path(key))
+}
+
+// SetExpires sets when the entry stored for URL key expires.
+func (d *DiskCache) SetExpires(ctx context.Context, key string, t time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	p := d.md5path(key)
+	m, err := d.readMeta(p)
+	if err != nil {
+		return err
+	}
+	m.Expires = t
+	return d.writeMeta(p, m)
+}
+
+// Walk calls fn with the metadata of each entry. Entries stored by older
+// versions have only Size and FetchedAt, taken from the file.
+func (d *DiskCache) Walk(ctx context.Context, fn func(m *Meta) error) error {
+	return d.walk(func(p string, fi Info) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		m, err := d.readMeta(p)
+		if err != nil {
+			m = &Meta{Size: fi.Size, FetchedAt: fi.ModTime}
+		}
+		return fn(m)
+	})
+}
+
+// Verify reads all the entries, quarantining the corrupt ones and the ones
+// whose body doesn't match the ContentHash of their metadata, and returns
+// how many were quarantined.
+func (d *DiskCache) Verify(ctx context.Context) (int, error) {
+	n := 0
+	err := d.walk(func(p string, fi Info) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, err := d.read(p)
+		if _, serr := d.storage().Stat(p); serr == ErrNotFound {
+			// removed meanwhile
+			return nil
+		}
+		if err == nil {
+			var body []byte
+			body, err = readBody(r)
+			m, merr := d.readMeta(p)
+			if err == nil && merr == nil {
+				sum := sha256.Sum256(body)
+				if hex.EncodeToString(sum[:]) != m.ContentHash {
+					err = errFormat
+				}
+			}
+		}
+		if err != nil {
+			n++
+			return d.quarantine(p)
+		}
+		return nil
+	})
+	return n, err
+}
+
+// ExpireOlderThan removes the entries fetched more than age ago and returns
+// how many were removed.
+func (d *DiskCache) ExpireOlderThan(ctx context.Context, age time.Duration) (int, error) {
+	limit := now().Add(-age)
+	n := 0
+	err := d.walk(func(p string, fi Info) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		t := fi.ModTime
+		if m, err := d.readMeta(p); err == nil {
+			t = m.FetchedAt
+		}
+		if !t.Before(limit) {
+			return nil
+		}
+		err := d.removeEntry(p)
+		if err == nil {
+			n++
+		}
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,36 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import "errors"
+
+// Mode tells DiskCache.Fetch and Transport when to use the network.
+type Mode int
+
+const (
+	// Record serves stored responses and fetches and stores the missing
+	// ones. It is the default.
+	Record Mode = iota
+	// Offline never uses the network: responses not stored are reported
+	// as ErrNotCached. A cache directory in Offline mode can be used as a
+	// fixture for tests.
+	Offline
+	// Refresh always fetches responses and replaces the stored ones.
+	Refresh
+)
+
+// ErrNotCached is returned in Offline mode for responses not stored.
+var ErrNotCached = errors.New("httpcache: not cached")
@@ -0,0 +1,96 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// headerStatus tells how Transport answered: "hit" from the cache, "miss"
+// from the origin, "revalidated" from the cache after asking the origin or
+// "stale" from the cache without asking the origin.
+const headerStatus = "X-Cache-Status"
+
+// headerFromCache is set to "true" in the responses served from a cache,
+// by both Transport and DiskCache.Fetch.
+const headerFromCache = "X-From-Cache"
+
+// serve returns the cached resp for req, with status in headerStatus.
+func serve(req *http.Request, resp *http.Response, status string) *http.Response {
+	resp.Header.Set(headerFromCache, "true")
+	resp.Header.Set(headerStatus, status)
+	resp.Request = req
+	return resp
+}
+
+// staleWithin reports whether the stale resp may be served for req, being
+// stale for less than def or the directive d of resp or req, RFC 5861.
+func staleWithin(req *http.Request, resp *http.Response, shared bool, d string, def time.Duration) bool {
+	cc := parseCacheControl(resp.Header)
+	if cc.has("must-revalidate") || (shared && cc.has("proxy-revalidate")) {
+		return false
+	}
+	window := def
+	if w, ok := cc.seconds(d); ok && w > window {
+		window = w
+	}
+	if w, ok := parseCacheControl(req.Header).seconds(d); ok && w > window {
+		window = w
+	}
+	stale := age(resp) - lifetime(resp, shared)
+	return stale >= 0 && stale < window
+}
+
+// serveStale reports whether the stale resp may be served for req while it
+// is revalidated in the background.
+func (t *Transport) serveStale(req *http.Request, resp *http.Response, shared bool) bool {
+	if parseCacheControl(req.Header).has("no-cache") || parseCacheControl(resp.Header).has("no-cache") {
+		return false
+	}
+	return staleWithin(req, resp, shared, "stale-while-revalidate", t.StaleWhileRevalidate)
+}
+
+// revalidate refreshes the stored response for req in the background,
+// unless it is already being refreshed.
+func (t *Transport) revalidate(req *http.Request) {
+	u := req.URL.String()
+	t.mu.Lock()
+	if t.revalidating[u] {
+		t.mu.Unlock()
+		return
+	}
+	if t.revalidating == nil {
+		t.revalidating = map[string]bool{}
+	}
+	t.revalidating[u] = true
+	t.mu.Unlock()
+
+	// the caller may cancel req as soon as it has the stale response
+	req = req.Clone(context.Background())
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.revalidating, u)
+			t.mu.Unlock()
+		}()
+		resp, err := t.forward(req, t.lookup(req), !t.Private)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+}
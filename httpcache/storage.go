@@ -0,0 +1,262 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage stores the files of a DiskCache by name. Names are slash
+// separated paths, like "ab/cdef".
+type Storage interface {
+	// Get returns the content of the file name, or ErrNotFound.
+	Get(name string) ([]byte, error)
+	// Put atomically replaces the file name with b: a reader sees
+	// either the old or the new content, never a partial one.
+	Put(name string, b []byte) error
+	// Delete removes the file name, if any.
+	Delete(name string) error
+	// Rename renames the file from to to, replacing it.
+	Rename(from, to string) error
+	// Stat returns information about the file name, or ErrNotFound.
+	Stat(name string) (Info, error)
+	// Walk calls fn for each file, in no particular order.
+	Walk(fn func(Info) error) error
+	Close() error
+}
+
+// Sidecars is implemented by the Storages kept on the local file system.
+// DiskCache keeps its index in the files at SidecarPath, next to the
+// Storage but not in it, because it appends to them.
+type Sidecars interface {
+	// SidecarPath returns the path of the local file name.
+	SidecarPath(name string) string
+}
+
+// Info describes a stored file.
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+var (
+	_ Storage = (*DirStorage)(nil)
+	_ Storage = (*MemoryStorage)(nil)
+	_ Storage = (*LogStorage)(nil)
+
+	_ Sidecars = (*DirStorage)(nil)
+	_ Sidecars = (*LogStorage)(nil)
+)
+
+// DirStorage keeps each file in a file under Base.
+type DirStorage struct {
+	Base string
+}
+
+func (s *DirStorage) path(name string) string {
+	return filepath.Join(s.Base, filepath.FromSlash(name))
+}
+
+// SidecarPath returns the path of name under Base.
+func (s *DirStorage) SidecarPath(name string) string {
+	return s.path(name)
+}
+
+func (s *DirStorage) Get(name string) ([]byte, error) {
+	b, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return b, err
+}
+
+func (s *DirStorage) Put(name string, b []byte) error {
+	p := s.path(name)
+	dir := filepath.Dir(p)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (s *DirStorage) Delete(name string) error {
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *DirStorage) Rename(from, to string) error {
+	p := s.path(to)
+	err := os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(s.path(from), p)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *DirStorage) Stat(name string) (Info, error) {
+	fi, err := os.Stat(s.path(name))
+	if os.IsNotExist(err) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Walk skips the temporary files of Put, which start with a dot.
+func (s *DirStorage) Walk(fn func(Info) error) error {
+	err := filepath.Walk(s.Base, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// removed meanwhile
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		name, err := filepath.Rel(s.Base, p)
+		if err != nil {
+			return err
+		}
+		return fn(Info{Name: filepath.ToSlash(name), Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *DirStorage) Close() error {
+	return nil
+}
+
+// MemoryStorage keeps the files in memory. It is meant for tests.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	files map[string]memoryFile
+}
+
+type memoryFile struct {
+	b     []byte
+	mtime time.Time
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: map[string]memoryFile{}}
+}
+
+func (s *MemoryStorage) Get(name string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), f.b...), nil
+}
+
+func (s *MemoryStorage) Put(name string, b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[name] = memoryFile{b: append([]byte(nil), b...), mtime: now()}
+	return nil
+}
+
+func (s *MemoryStorage) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, name)
+	return nil
+}
+
+func (s *MemoryStorage) Rename(from, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, ok := s.files[from]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.files, from)
+	s.files[to] = f
+	return nil
+}
+
+func (s *MemoryStorage) Stat(name string) (Info, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.files[name]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	return Info{Name: name, Size: int64(len(f.b)), ModTime: f.mtime}, nil
+}
+
+func (s *MemoryStorage) Walk(fn func(Info) error) error {
+	s.mu.RLock()
+	is := make([]Info, 0, len(s.files))
+	for name, f := range s.files {
+		is = append(is, Info{Name: name, Size: int64(len(f.b)), ModTime: f.mtime})
+	}
+	s.mu.RUnlock()
+	for _, i := range is {
+		err := fn(i)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,231 @@
+package httpcache
+
+import (
+	"context"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func testStorage(t *testing.T, s Storage) {
+	if _, err := s.Get("ab/c"); err != ErrNotFound {
+		t.Errorf("Get: want %v, got %v", ErrNotFound, err)
+	}
+	s.Put("ab/c", []byte("1"))
+	s.Put("ab/c", []byte("22"))
+	s.Put("x/y/z", []byte("333"))
+	if b, err := s.Get("ab/c"); string(b) != "22" || err != nil {
+		t.Errorf("Get: got %q %v", b, err)
+	}
+	if fi, err := s.Stat("x/y/z"); fi.Size != 3 || fi.ModTime.IsZero() || err != nil {
+		t.Errorf("Stat: got %+v %v", fi, err)
+	}
+	if err := s.Rename("x/y/z", "q/z"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename("x/y/z", "q/z"); err != ErrNotFound {
+		t.Errorf("Rename of a missing file: want %v, got %v", ErrNotFound, err)
+	}
+	var names []string
+	s.Walk(func(fi Info) error {
+		names = append(names, fi.Name)
+		return nil
+	})
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "ab/c" || names[1] != "q/z" {
+		t.Errorf("Walk: got %v", names)
+	}
+	s.Delete("ab/c")
+	if err := s.Delete("ab/c"); err != nil {
+		t.Errorf("Delete of a missing file: %v", err)
+	}
+	if _, err := s.Stat("ab/c"); err != ErrNotFound {
+		t.Errorf("Stat after Delete: want %v, got %v", ErrNotFound, err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	testStorage(t, &DirStorage{Base: tempCache(t).Base})
+	testStorage(t, NewMemoryStorage())
+	s, err := OpenLogStorage(filepath.Join(tempCache(t).Base, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStorage(t, s)
+}
+
+func TestDiskCache_Storage(t *testing.T) {
+	ctx := context.Background()
+	log, err := OpenLogStorage(filepath.Join(tempCache(t).Base, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	for _, s := range []Storage{NewMemoryStorage(), log} {
+		d := &DiskCache{Storage: s, Dedup: true, MaxEntries: 2}
+		testCache(t, d)
+		for _, u := range []string{"http://example.com/a", "http://example.com/b", "http://example.com/c"} {
+			d.Put(ctx, u, response("body"))
+		}
+		n := 0
+		d.Walk(ctx, func(m *Meta) error {
+			n++
+			return nil
+		})
+		if n != 2 {
+			t.Errorf("%T: want 2 entries after eviction, got %d", s, n)
+		}
+		if _, err := d.Get(ctx, "http://example.com/c"); err != nil {
+			t.Errorf("%T: %v", s, err)
+		}
+	}
+}
+
+func TestLogStorage(t *testing.T) {
+	p := filepath.Join(tempCache(t).Base, "log")
+	os.MkdirAll(filepath.Dir(p), 0755)
+	s, err := OpenLogStorage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", []byte("1"))
+	s.Put("b", []byte("2"))
+	s.Put("a", []byte("3"))
+	s.Close()
+
+	// without the hint the whole log is read
+	os.Remove(p + ".hint")
+	s, err = OpenLogStorage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Delete("b")
+	s.Put("c", []byte("4"))
+	s.Close()
+
+	// a record cut by a crash after the hint
+	f, _ := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(logRecord(logPut, "d", []byte("5"), now())[:10])
+	f.Close()
+
+	s, err = OpenLogStorage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	want := map[string]string{"a": "3", "c": "4"}
+	check := func() {
+		got := map[string]string{}
+		s.Walk(func(fi Info) error {
+			b, err := s.Get(fi.Name)
+			if err != nil {
+				t.Error(err)
+			}
+			got[fi.Name] = string(b)
+			return nil
+		})
+		if len(got) != len(want) || got["a"] != want["a"] || got["c"] != want["c"] {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	}
+	check()
+	if s.Garbage() == 0 {
+		t.Errorf("no garbage after replacing and deleting")
+	}
+	before, _ := os.Stat(p)
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := os.Stat(p)
+	if after.Size() >= before.Size() || s.Garbage() != 0 {
+		t.Errorf("Compact: size %d -> %d, garbage %d", before.Size(), after.Size(), s.Garbage())
+	}
+	check()
+	s.Put("e", []byte("6"))
+	if b, _ := ioutil.ReadFile(p); len(b) == 0 {
+		t.Errorf("log empty after Put")
+	}
+	if b, _ := s.Get("e"); string(b) != "6" {
+		t.Errorf("Get after Compact: got %q", b)
+	}
+}
+
+func TestLogStorage_Corrupt(t *testing.T) {
+	p := filepath.Join(tempCache(t).Base, "log")
+	os.MkdirAll(filepath.Dir(p), 0755)
+	s, err := OpenLogStorage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Put("a", []byte("1"))
+	s.Put("b", []byte("2"))
+	s.Put("c", []byte("3"))
+	s.Close()
+	os.Remove(p + ".hint")
+
+	// a header claiming 4 GiB at the end is torn, not allocated
+	rec := logRecord(logPut, "d", nil, now())
+	binary.BigEndian.PutUint32(rec[17:21], 1<<32-1)
+	f, _ := os.OpenFile(p, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(rec)
+	f.Close()
+	fi, _ := os.Stat(p)
+	s, err = OpenLogStorage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	os.Remove(p + ".hint")
+	if fi2, _ := os.Stat(p); fi2.Size() != fi.Size()-int64(len(rec)) {
+		t.Errorf("want the torn record dropped, size %d -> %d", fi.Size(), fi2.Size())
+	}
+
+	// a bad record in the middle
+	b, _ := ioutil.ReadFile(p)
+	b[logHeader+1] ^= 0xff
+	ioutil.WriteFile(p, b, 0644)
+	if _, err := OpenLogStorage(p); err != errLogCorrupt {
+		t.Errorf("want %v, got %v", errLogCorrupt, err)
+	}
+	if fi, _ := os.Stat(p); fi.Size() != int64(len(b)) {
+		t.Errorf("log truncated from %d to %d bytes", len(b), fi.Size())
+	}
+}
+
+func TestDiskCache_LogIndex(t *testing.T) {
+	ctx := context.Background()
+	p := filepath.Join(tempCache(t).Base, "log")
+	os.MkdirAll(filepath.Dir(p), 0755)
+	s, err := OpenLogStorage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &DiskCache{Storage: s}
+	for i := 0; i < 3*saveEvery; i++ {
+		d.Put(ctx, "http://a/", response("x"))
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the index is kept next to the log, not in it
+	if _, err := os.Stat(p + ".index"); err != nil {
+		t.Error(err)
+	}
+	s, err = OpenLogStorage(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Stat(d.indexPath()); err != ErrNotFound {
+		t.Errorf("index in the log: %v", err)
+	}
+	d = &DiskCache{Storage: s, MaxEntries: 1}
+	d.openIndex()
+	if n := len(d.index.entries); n != 1 {
+		t.Errorf("want 1 entry in the index, got %d", n)
+	}
+}
@@ -0,0 +1,254 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Transport is an http.RoundTripper that caches responses following the
+// HTTP caching rules of RFC 9111.
+type Transport struct {
+	// Transport makes the actual requests.
+	// Defaults to http.DefaultTransport.
+	Transport http.RoundTripper
+	Cache     Cache
+	// Private makes Transport behave as a private cache: responses marked
+	// private are stored and s-maxage is ignored.
+	Private bool
+	// Mode tells when to use the network. In Offline mode stored
+	// responses are served even if stale.
+	Mode Mode
+
+	// StaleIfError is how long after becoming stale a response is still
+	// served when the origin can't be reached or answers with a 5xx.
+	// StaleWhileRevalidate is how long after becoming stale a response is
+	// served while it is revalidated in the background. The
+	// stale-if-error and stale-while-revalidate directives of RFC 5861
+	// extend them.
+	StaleIfError         time.Duration
+	StaleWhileRevalidate time.Duration
+
+	mu           sync.Mutex
+	revalidating map[string]bool
+}
+
+// NewTransport returns a Transport caching in c.
+func NewTransport(c Cache) *Transport {
+	return &Transport{Cache: c}
+}
+
+// Client returns an *http.Client using t.
+func (t *Transport) Client() *http.Client {
+	return &http.Client{Transport: t}
+}
+
+func (t *Transport) transport() http.RoundTripper {
+	if t.Transport == nil {
+		return http.DefaultTransport
+	}
+	return t.Transport
+}
+
+func unsafeMethod(m string) bool {
+	switch m {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return false
+	}
+	return true
+}
+
+// RoundTrip serves req from the cache if there is a fresh response,
+// revalidates a stale response and stores new responses when allowed.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	u := req.URL.String()
+	if t.Mode == Offline {
+		return t.offline(req)
+	}
+	if req.Method != "GET" {
+		resp, err := t.transport().RoundTrip(req)
+		if err == nil && unsafeMethod(req.Method) && resp.StatusCode < 400 {
+			// section 4.4
+			t.Cache.Delete(req.Context(), u)
+		}
+		return resp, err
+	}
+
+	shared := !t.Private
+	var cached *http.Response
+	if t.Mode != Refresh {
+		cached = t.lookup(req)
+	}
+
+	if cached != nil && fresh(req, cached, shared) {
+		return serve(req, cached, "hit"), nil
+	}
+	if cached == nil && parseCacheControl(req.Header).has("only-if-cached") {
+		return &http.Response{
+			Status:     "504 Gateway Timeout",
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+			Request:    req,
+		}, nil
+	}
+	if cached != nil && t.serveStale(req, cached, shared) {
+		t.revalidate(req)
+		return serve(req, cached, "stale"), nil
+	}
+	return t.forward(req, cached, shared)
+}
+
+// forward makes req, conditional if there is a cached response, and
+// stores the response.
+func (t *Transport) forward(req *http.Request, cached *http.Response, shared bool) (*http.Response, error) {
+	outreq := req
+	if cached != nil {
+		// section 4.3.1
+		etag := cached.Header.Get("ETag")
+		lm := cached.Header.Get("Last-Modified")
+		if etag != "" || lm != "" {
+			outreq = req.Clone(req.Context())
+			if etag != "" && req.Header.Get("If-None-Match") == "" {
+				outreq.Header.Set("If-None-Match", etag)
+			}
+			if lm != "" && req.Header.Get("If-Modified-Since") == "" {
+				outreq.Header.Set("If-Modified-Since", lm)
+			}
+		}
+	}
+
+	reqTime := now()
+	resp, err := t.transport().RoundTrip(outreq)
+	respTime := now()
+	if cached != nil && (err != nil || resp.StatusCode >= 500) &&
+		staleWithin(req, cached, shared, "stale-if-error", t.StaleIfError) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		return serve(req, cached, "stale"), nil
+	}
+	if err != nil {
+		if cached != nil {
+			cached.Body.Close()
+		}
+		return nil, err
+	}
+
+	if cached != nil && resp.StatusCode == http.StatusNotModified && outreq != req {
+		// section 4.3.4
+		resp.Body.Close()
+		for k, vs := range resp.Header {
+			switch k {
+			case "Content-Length", "Content-Encoding", "Transfer-Encoding":
+				continue
+			}
+			cached.Header[k] = vs
+		}
+		setTimes(cached.Header, reqTime, respTime)
+		resp, err = t.save(req, cached)
+		if err != nil {
+			return nil, err
+		}
+		return serve(req, resp, "revalidated"), nil
+	}
+	if cached != nil {
+		cached.Body.Close()
+	}
+
+	if !storable(req, resp, shared) {
+		resp.Header.Set(headerStatus, "miss")
+		return resp, nil
+	}
+	setTimes(resp.Header, reqTime, respTime)
+	for _, name := range varyNames(resp.Header) {
+		resp.Header.Set(headerVaried+name, varyValue(req.Header, name))
+	}
+	resp, err = t.save(req, resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set(headerStatus, "miss")
+	return resp, nil
+}
+
+// lookup returns the stored response for req, or nil. If the response
+// varies the entry of the URL is a stub pointing to the variants.
+func (t *Transport) lookup(req *http.Request) *http.Response {
+	u := req.URL.String()
+	cached, err := t.Cache.Get(req.Context(), u)
+	if err != nil {
+		return nil
+	}
+	if cached.Header.Get(headerStub) != "" {
+		cached.Body.Close()
+		cached, err = t.Cache.Get(req.Context(), variantKey(u, varyNames(cached.Header), req.Header))
+		if err != nil {
+			return nil
+		}
+	}
+	if !varyMatches(req, cached) {
+		cached.Body.Close()
+		return nil
+	}
+	return cached
+}
+
+// offline serves req from the cache only.
+func (t *Transport) offline(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return nil, ErrNotCached
+	}
+	cached := t.lookup(req)
+	if cached == nil {
+		return nil, ErrNotCached
+	}
+	return serve(req, cached, "hit"), nil
+}
+
+func setTimes(h http.Header, reqTime, respTime time.Time) {
+	h.Set(headerRequestTime, reqTime.UTC().Format(time.RFC3339Nano))
+	h.Set(headerResponseTime, respTime.UTC().Format(time.RFC3339Nano))
+}
+
+// save stores resp and returns it with a readable body.
+func (t *Transport) save(req *http.Request, resp *http.Response) (*http.Response, error) {
+	_, err := readBody(resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.TransferEncoding = nil
+	resp.Header.Del("Transfer-Encoding")
+	// a response that can't be stored is still a good response
+	u := req.URL.String()
+	if names := varyNames(resp.Header); len(names) > 0 {
+		err = t.Cache.Put(req.Context(), variantKey(u, names, req.Header), resp)
+		if err == nil {
+			t.Cache.Put(req.Context(), u, stub(resp))
+		}
+	} else {
+		t.Cache.Put(req.Context(), u, resp)
+	}
+	resp.Request = req
+	return resp, nil
+}
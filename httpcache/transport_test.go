@@ -0,0 +1,241 @@
+package httpcache
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func tempCache(t *testing.T) *DiskCache {
+	dir, err := ioutil.TempDir("", "httpcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return NewDiskCache(dir)
+}
+
+// file returns the path of the file name of d.
+func file(d *DiskCache, name string) string {
+	return filepath.Join(d.Base, filepath.FromSlash(name))
+}
+
+// travel moves the clock of the cache forward by d.
+func travel(t *testing.T, d time.Duration) {
+	old := now
+	now = func() time.Time { return old().Add(d) }
+	t.Cleanup(func() { now = old })
+}
+
+func get(t *testing.T, c *http.Client, u string, h ...string) (string, bool) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(h); i += 2 {
+		req.Header.Set(h[i], h[i+1])
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), resp.Header.Get(headerFromCache) == "true"
+}
+
+func TestTransport(t *testing.T) {
+	hits := map[string]int{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits[r.URL.Path]++
+		switch r.URL.Path {
+		case "/max-age":
+			w.Header().Set("Cache-Control", "max-age=60")
+		case "/no-store":
+			w.Header().Set("Cache-Control", "no-store")
+		case "/private":
+			w.Header().Set("Cache-Control", "private, max-age=60")
+		case "/etag":
+			w.Header().Set("Cache-Control", "no-cache")
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.Header().Set("X-Revalidated", "yes")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/heuristic":
+			w.Header().Set("Last-Modified", time.Now().Add(-100*time.Minute).UTC().Format(http.TimeFormat))
+		case "/vary":
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		fmt.Fprintf(w, "%s %d %s", r.URL.Path, hits[r.URL.Path], r.Header.Get("Accept-Language"))
+	}))
+	defer ts.Close()
+
+	c := NewTransport(tempCache(t)).Client()
+
+	tests := []struct {
+		path   string
+		header []string
+		body   string
+		cached bool
+	}{
+		{"/max-age", nil, "/max-age 1 ", false},
+		{"/max-age", nil, "/max-age 1 ", true},
+		{"/max-age", []string{"Cache-Control", "no-cache"}, "/max-age 2 ", false},
+		{"/no-store", nil, "/no-store 1 ", false},
+		{"/no-store", nil, "/no-store 2 ", false},
+		{"/private", nil, "/private 1 ", false},
+		{"/private", nil, "/private 2 ", false},
+		{"/etag", nil, "/etag 1 ", false},
+		{"/etag", nil, "/etag 1 ", true},
+		{"/heuristic", nil, "/heuristic 1 ", false},
+		{"/heuristic", nil, "/heuristic 1 ", true},
+		{"/vary", []string{"Accept-Language", "it"}, "/vary 1 it", false},
+		{"/vary", []string{"Accept-Language", "it"}, "/vary 1 it", true},
+		{"/vary", []string{"Accept-Language", "en"}, "/vary 2 en", false},
+	}
+	for _, tt := range tests {
+		body, cached := get(t, c, ts.URL+tt.path, tt.header...)
+		if body != tt.body || cached != tt.cached {
+			t.Errorf("%s %q: want %q (cached %v), got %q (cached %v)", tt.path, tt.header, tt.body, tt.cached, body, cached)
+		}
+	}
+	if hits["/etag"] != 2 {
+		t.Errorf("/etag: want 2 requests, got %d", hits["/etag"])
+	}
+
+	travel(t, 2*time.Minute)
+	body, cached := get(t, c, ts.URL+"/max-age")
+	if body != "/max-age 3 " || cached {
+		t.Errorf("stale /max-age served: %q (cached %v)", body, cached)
+	}
+	// 10% of 100 minutes
+	travel(t, 9*time.Minute)
+	body, cached = get(t, c, ts.URL+"/heuristic")
+	if body != "/heuristic 2 " || cached {
+		t.Errorf("stale /heuristic served: %q (cached %v)", body, cached)
+	}
+}
+
+func TestTransport_Stale(t *testing.T) {
+	var down int32
+	var hits [2]int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&down) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		// the clock of the server doesn't travel
+		w.Header()["Date"] = nil
+		w.Header().Set("Cache-Control", "max-age=60")
+		i := 0
+		if r.URL.Path == "/swr" {
+			w.Header().Set("Cache-Control", "max-age=60, stale-while-revalidate=600")
+			i = 1
+		}
+		fmt.Fprintf(w, "%s %d", r.URL.Path, atomic.AddInt32(&hits[i], 1))
+	}))
+	defer ts.Close()
+
+	tr := NewTransport(tempCache(t))
+	tr.StaleIfError = time.Hour
+	c := tr.Client()
+	status := func(u string) (string, string) {
+		resp, err := c.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b), resp.Header.Get(headerStatus)
+	}
+	tests := []struct {
+		path, body, status string
+	}{
+		{"/", "/ 1", "miss"},
+		{"/", "/ 1", "hit"},
+		{"/swr", "/swr 1", "miss"},
+	}
+	for _, tt := range tests {
+		if b, s := status(ts.URL + tt.path); b != tt.body || s != tt.status {
+			t.Errorf("%s: want %q %q, got %q %q", tt.path, tt.body, tt.status, b, s)
+		}
+	}
+
+	travel(t, 2*time.Minute)
+	atomic.StoreInt32(&down, 1)
+	if b, s := status(ts.URL + "/"); b != "/ 1" || s != "stale" {
+		t.Errorf("stale-if-error: got %q %q", b, s)
+	}
+	atomic.StoreInt32(&down, 0)
+
+	if b, s := status(ts.URL + "/swr"); b != "/swr 1" || s != "stale" {
+		t.Errorf("stale-while-revalidate: got %q %q", b, s)
+	}
+	// wait for the background revalidation
+	for i := 0; i < 100; i++ {
+		tr.mu.Lock()
+		n := len(tr.revalidating)
+		tr.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if b, s := status(ts.URL + "/swr"); b != "/swr 2" || s != "hit" {
+		t.Errorf("not revalidated in background: got %q %q", b, s)
+	}
+
+	travel(t, 2*time.Hour)
+	atomic.StoreInt32(&down, 1)
+	if b, s := status(ts.URL + "/"); b != "" || s != "miss" {
+		t.Errorf("stale-if-error past the window: got %q %q", b, s)
+	}
+}
+
+func TestTransport_Vary(t *testing.T) {
+	hits := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language, Accept-Encoding")
+		fmt.Fprintf(w, "%d %s", hits, r.Header.Get("Accept-Language"))
+	}))
+	defer ts.Close()
+
+	d := tempCache(t)
+	c := NewTransport(d).Client()
+	tests := []struct {
+		lang   string
+		body   string
+		cached bool
+	}{
+		{"it", "1 it", false},
+		{"en", "2 en", false},
+		{"it", "1 it", true},
+		{"en", "2 en", true},
+		{"", "3 ", false},
+		{"", "3 ", true},
+	}
+	for _, tt := range tests {
+		body, cached := get(t, c, ts.URL, "Accept-Language", tt.lang, "Accept-Encoding", "identity")
+		if body != tt.body || cached != tt.cached {
+			t.Errorf("%q: want %q (cached %v), got %q (cached %v)", tt.lang, tt.body, tt.cached, body, cached)
+		}
+	}
+	// another Accept-Encoding is another variant
+	if body, cached := get(t, c, ts.URL, "Accept-Language", "it", "Accept-Encoding", "br"); body != "4 it" || cached {
+		t.Errorf("got %q (cached %v)", body, cached)
+	}
+}
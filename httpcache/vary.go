@@ -0,0 +1,96 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A response with a Vary header is stored once for each combination of
+// the request headers it names, its variants, under variant keys: the URL
+// followed by variantSep and the headers, like
+//
+//	http://example.com/ vary:Accept-Language=it
+//
+// The entry of the URL is a stub, marked with headerStub, with the Vary
+// header of the last response stored, telling which variant key to look
+// for.
+const (
+	variantSep = " vary:"
+	headerStub = "X-Cache-Stub"
+)
+
+// varyNames returns the header names listed by the Vary header of h.
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h["Vary"] {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// varyValue returns the value of the header name of a request, as
+// compared when selecting a variant.
+func varyValue(h http.Header, name string) string {
+	return strings.Join(h[name], ", ")
+}
+
+// varyMatches reports whether the request headers selected by the Vary
+// header of the stored resp match the ones of req.
+func varyMatches(req *http.Request, resp *http.Response) bool {
+	for _, name := range varyNames(resp.Header) {
+		if name == "*" {
+			return false
+		}
+		if varyValue(req.Header, name) != resp.Header.Get(headerVaried+name) {
+			return false
+		}
+	}
+	return true
+}
+
+// variantKey returns the key of the variant of URL u for the request
+// headers h.
+func variantKey(u string, names []string, h http.Header) string {
+	v := url.Values{}
+	for _, name := range names {
+		v.Set(name, varyValue(h, name))
+	}
+	// Encode sorts by name
+	return u + variantSep + v.Encode()
+}
+
+// stub returns the stub pointing to the variants of resp.
+func stub(resp *http.Response) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Vary": resp.Header["Vary"], headerStub: {"1"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(nil)),
+	}
+}
@@ -0,0 +1,199 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package httpcache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"xojoc.pw/crawl/warc"
+)
+
+// WARCCache is a Cache keeping the responses in a WARC file. Put appends a
+// response record and Delete a metadata record marking the URL deleted, so
+// the file is also a record of everything fetched.
+type WARCCache struct {
+	mu    sync.RWMutex
+	f     *os.File
+	w     *warc.Writer
+	base  int64
+	index map[string]int64
+}
+
+var _ Cache = (*WARCCache)(nil)
+
+// deleted is the block of the metadata records written by Delete.
+var deleted = []byte("httpcache: deleted\r\n")
+
+// HeaderVariant is the WARC header holding the request headers of a
+// variant, so that WARC-Target-URI is always a URL.
+const HeaderVariant = "HTTPCache-Variant"
+
+// NewRecord returns a response record for r, fetched at date, stored under
+// the key k.
+func NewRecord(k string, date time.Time, r *http.Response) (*warc.Record, error) {
+	u, v := splitKey(k)
+	rec, err := warc.NewResponse(u, date, r)
+	if err != nil {
+		return nil, err
+	}
+	if v != "" {
+		rec.Set(HeaderVariant, v)
+	}
+	return rec, nil
+}
+
+// RecordKey returns the key of the record rec.
+func RecordKey(rec *warc.Record) string {
+	if v := rec.Get(HeaderVariant); v != "" {
+		return rec.TargetURI + variantSep + v
+	}
+	return rec.TargetURI
+}
+
+// splitKey splits k into the URL and the variant, if any.
+func splitKey(k string) (u, variant string) {
+	if i := strings.Index(k, variantSep); i >= 0 {
+		return k[:i], k[i+len(variantSep):]
+	}
+	return k, ""
+}
+
+// OpenWARCCache opens, or creates, the WARC file at path. A record
+// truncated by a crash at the end of the file is removed. Any other bad
+// record is an error.
+func OpenWARCCache(path string) (*WARCCache, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c := &WARCCache{f: f, index: map[string]int64{}}
+	r := warc.NewReader(f)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err == io.ErrUnexpectedEOF {
+			// the input ended inside the record
+			err = f.Truncate(r.Offset())
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		switch {
+		case rec.Type == warc.Response:
+			c.index[key(RecordKey(rec))] = r.Offset()
+		case rec.Type == warc.Metadata && bytes.Equal(rec.Block, deleted):
+			delete(c.index, key(RecordKey(rec)))
+		}
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.base = fi.Size()
+	c.w = warc.NewWriter(f)
+	return c, nil
+}
+
+func (c *WARCCache) Get(ctx context.Context, k string) (*http.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	off, ok := c.index[key(k)]
+	c.mu.RUnlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	rec, err := warc.NewReader(io.NewSectionReader(c.f, off, 1<<62)).Next()
+	if err != nil {
+		return nil, err
+	}
+	return rec.Response()
+}
+
+func (c *WARCCache) Put(ctx context.Context, k string, r *http.Response) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec, err := NewRecord(k, now(), r)
+	if err != nil {
+		return err
+	}
+	off := c.base + c.w.Offset()
+	_, err = c.w.Write(rec)
+	if err != nil {
+		return err
+	}
+	c.index[key(k)] = off
+	return nil
+}
+
+func (c *WARCCache) Delete(ctx context.Context, k string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.index[key(k)]; !ok {
+		return nil
+	}
+	u, v := splitKey(k)
+	rec := &warc.Record{Type: warc.Metadata, TargetURI: u, ContentType: warc.Fields, Block: deleted}
+	if v != "" {
+		rec.Set(HeaderVariant, v)
+	}
+	_, err := c.w.Write(rec)
+	if err != nil {
+		return err
+	}
+	delete(c.index, key(k))
+	return nil
+}
+
+func (c *WARCCache) Has(ctx context.Context, k string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+	c.mu.RLock()
+	_, ok := c.index[key(k)]
+	c.mu.RUnlock()
+	return ok, nil
+}
+
+// Close closes the WARC file.
+func (c *WARCCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.f.Close()
+}
@@ -0,0 +1,182 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package robots
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errValue = errors.New("robots: bad value")
+
+// Rate is a Request-rate, like "1/10s": at most Requests every Per.
+type Rate struct {
+	Requests int
+	Per      time.Duration
+}
+
+// interval returns the time between two requests at rate r, 0 if r is
+// not set.
+func (r Rate) interval() time.Duration {
+	if r.Requests <= 0 {
+		return 0
+	}
+	return r.Per / time.Duration(r.Requests)
+}
+
+// VisitTime is a Visit-time, like "0600-0845": the host can be accessed
+// only from Start to End, as times from midnight UTC. If End is before
+// Start the range spans midnight.
+type VisitTime struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// contains returns true if the time of the day d is within v.
+func (v VisitTime) contains(d time.Duration) bool {
+	if v.Start <= v.End {
+		return v.Start <= d && d < v.End
+	}
+	return d >= v.Start || d < v.End
+}
+
+func (g *Group) delay() time.Duration {
+	d := g.CrawlDelay
+	if i := g.RequestRate.interval(); i > d {
+		d = i
+	}
+	return d
+}
+
+// Next returns the earliest time ua may access the host again after an
+// access at last, or for the first time if last is zero: at least the
+// longest of delay, the minimum of the caller, and Delay after last and,
+// if there are Visit-times, within one of them.
+func (t *Txt) Next(ua string, last time.Time, delay time.Duration) time.Time {
+	next := time.Now()
+	g := t.Group(ua)
+	if !last.IsZero() {
+		if g != nil && g.delay() > delay {
+			delay = g.delay()
+		}
+		next = last.Add(delay)
+	}
+	if g == nil || len(g.VisitTimes) == 0 {
+		return next
+	}
+	next = next.UTC()
+	day := next.Truncate(24 * time.Hour)
+	var first time.Time
+	for _, v := range g.VisitTimes {
+		if v.contains(next.Sub(day)) {
+			return next
+		}
+		s := day.Add(v.Start)
+		if s.Before(next) {
+			s = s.Add(24 * time.Hour)
+		}
+		if first.IsZero() || s.Before(first) {
+			first = s
+		}
+	}
+	return first
+}
+
+// parseDelay parses a Crawl-delay, seconds possibly with a fraction.
+func parseDelay(s string) (time.Duration, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if f < 0 || math.IsNaN(f) || f > float64(math.MaxInt64/int64(time.Second)) {
+		return 0, errValue
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// parseRate parses a Request-rate: requests/period where period is a
+// number of seconds, minutes, hours or days, like 10s, 5m, 1h or 1d.
+// Seconds are the default unit.
+func parseRate(s string) (Rate, error) {
+	// a time range may follow, like "1/10s 0600-0845"; it is ignored
+	if f := strings.Fields(s); len(f) > 0 {
+		s = f[0]
+	}
+	i := strings.IndexByte(s, '/')
+	if i < 0 {
+		return Rate{}, errValue
+	}
+	n, err := strconv.Atoi(s[:i])
+	if err != nil || n <= 0 {
+		return Rate{}, errValue
+	}
+	per, unit := s[i+1:], time.Second
+	if l := len(per); l > 0 {
+		switch per[l-1] {
+		case 's', 'S':
+			per = per[:l-1]
+		case 'm', 'M':
+			per, unit = per[:l-1], time.Minute
+		case 'h', 'H':
+			per, unit = per[:l-1], time.Hour
+		case 'd', 'D':
+			per, unit = per[:l-1], 24*time.Hour
+		}
+	}
+	p, err := strconv.Atoi(per)
+	if err != nil || p <= 0 || int64(p) > math.MaxInt64/int64(unit) {
+		return Rate{}, errValue
+	}
+	return Rate{Requests: n, Per: time.Duration(p) * unit}, nil
+}
+
+// parseVisitTime parses a Visit-time, hhmm-hhmm in UTC.
+func parseVisitTime(s string) (VisitTime, error) {
+	s = strings.Replace(s, ":", "", -1)
+	s = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s), "UTC"))
+	i := strings.IndexByte(s, '-')
+	if i < 0 {
+		return VisitTime{}, errValue
+	}
+	start, err := parseClock(strings.TrimSpace(s[:i]))
+	if err != nil {
+		return VisitTime{}, err
+	}
+	end, err := parseClock(strings.TrimSpace(s[i+1:]))
+	if err != nil {
+		return VisitTime{}, err
+	}
+	return VisitTime{Start: start, End: end}, nil
+}
+
+// parseClock parses hhmm, from 0000 to 2400.
+func parseClock(s string) (time.Duration, error) {
+	if len(s) != 4 {
+		return 0, errValue
+	}
+	h, err := strconv.Atoi(s[:2])
+	if err != nil {
+		return 0, errValue
+	}
+	m, err := strconv.Atoi(s[2:])
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, errValue
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
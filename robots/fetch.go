@@ -0,0 +1,234 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package robots
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxRedirects is the number of redirects followed by Fetch.
+const MaxRedirects = 5
+
+// allowAll returns the rules used when robots.txt is unavailable.
+func allowAll() *Txt {
+	return &Txt{}
+}
+
+// disallowAll returns the rules used when robots.txt is unreachable.
+func disallowAll() *Txt {
+	return &Txt{Groups: []*Group{{UserAgents: []string{"*"}, Disallow: []string{"/"}}}}
+}
+
+// Fetch fetches and parses the robots.txt of host, like
+// "https://example.com", with client, or http.DefaultClient if nil.
+//
+// As in RFC 9309, up to MaxRedirects redirects are followed. If
+// robots.txt is unavailable, that is the status is 4xx except 429, or
+// there are too many redirects, the returned Txt allows everything. If it
+// is unreachable, that is the status is 5xx or 429 or the request fails,
+// the returned Txt disallows everything and the error says why.
+func Fetch(ctx context.Context, client *http.Client, host string) (*Txt, error) {
+	return fetch(ctx, client, host, "")
+}
+
+func fetch(ctx context.Context, client *http.Client, host string, ua string) (*Txt, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	c := *client
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return disallowAll(), err
+	}
+	u = u.ResolveReference(&url.URL{Path: "/robots.txt"})
+	for hops := 0; ; hops++ {
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return disallowAll(), err
+		}
+		req = req.WithContext(ctx)
+		if ua != "" {
+			req.Header.Set("User-Agent", ua)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			return disallowAll(), err
+		}
+		switch s := resp.StatusCode; {
+		case s >= 200 && s < 300:
+			defer resp.Body.Close()
+			txt, err := Parse(resp.Body)
+			if err != nil {
+				return disallowAll(), err
+			}
+			return txt, nil
+		case s >= 300 && s < 400:
+			resp.Body.Close()
+			loc, err := resp.Location()
+			if err != nil || hops == MaxRedirects {
+				return allowAll(), nil
+			}
+			u = loc
+		case s >= 400 && s < 500 && s != http.StatusTooManyRequests:
+			resp.Body.Close()
+			return allowAll(), nil
+		default:
+			resp.Body.Close()
+			return disallowAll(), fmt.Errorf("robots: %s: %s", u, resp.Status)
+		}
+	}
+}
+
+// Checker tells whether a URL can be crawled according to the robots.txt
+// of its host, fetched on first use and cached per scheme, host and port.
+// Stale entries are refreshed in the background while the old rules are
+// still used. Its methods can be called concurrently.
+type Checker struct {
+	// Client fetches robots.txt. Defaults to http.DefaultClient.
+	Client    *http.Client
+	UserAgent string
+	// TTL is how long robots.txt is cached. Defaults to 24 hours.
+	TTL time.Duration
+	// ErrorTTL is how long an unreachable robots.txt is retried after,
+	// meanwhile Txt returns the error or, if the robots.txt was fetched
+	// before, the old rules. Without old rules the first Txt after
+	// ErrorTTL fetches robots.txt again. Defaults to 1 hour.
+	ErrorTTL time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*checkerHost
+}
+
+type checkerHost struct {
+	ready      chan struct{}
+	txt        *Txt
+	err        error // set until robots.txt is fetched once
+	expires    time.Time
+	refreshing bool
+}
+
+func (c *Checker) ttl(err error) time.Duration {
+	if err != nil {
+		if c.ErrorTTL > 0 {
+			return c.ErrorTTL
+		}
+		return time.Hour
+	}
+	if c.TTL > 0 {
+		return c.TTL
+	}
+	return 24 * time.Hour
+}
+
+// origin returns the scheme, host and port of u, like
+// "https://example.com:443".
+func origin(u *url.URL) string {
+	scheme := strings.ToLower(u.Scheme)
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if scheme == "https" {
+			port = "443"
+		}
+	}
+	return scheme + "://" + net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+// Txt returns the robots.txt rules for the host of u, fetching them if
+// not cached. If robots.txt is unreachable, or ctx is cancelled before it
+// is fetched, the error says why and the returned Txt disallows
+// everything.
+func (c *Checker) Txt(ctx context.Context, u *url.URL) (*Txt, error) {
+	key := origin(u)
+	c.mu.Lock()
+	if c.hosts == nil {
+		c.hosts = map[string]*checkerHost{}
+	}
+	h, ok := c.hosts[key]
+	if !ok {
+		h = &checkerHost{ready: make(chan struct{})}
+		c.hosts[key] = h
+		c.mu.Unlock()
+		txt, err := fetch(ctx, c.Client, key, c.UserAgent)
+		c.mu.Lock()
+		h.txt, h.err, h.expires = txt, err, time.Now().Add(c.ttl(err))
+		if ctx.Err() != nil {
+			// don't keep the result of a cancelled fetch
+			h.err = ctx.Err()
+			delete(c.hosts, key)
+		}
+		err = h.err
+		c.mu.Unlock()
+		close(h.ready)
+		return txt, err
+	}
+	c.mu.Unlock()
+	select {
+	case <-h.ready:
+	case <-ctx.Done():
+		return disallowAll(), ctx.Err()
+	}
+	c.mu.Lock()
+	if h.err != nil && time.Now().After(h.expires) {
+		// there are no old rules to use meanwhile, fetch them again
+		if c.hosts[key] == h {
+			delete(c.hosts, key)
+		}
+		c.mu.Unlock()
+		return c.Txt(ctx, u)
+	}
+	defer c.mu.Unlock()
+	if !h.refreshing && time.Now().After(h.expires) {
+		h.refreshing = true
+		go c.refresh(key, h)
+	}
+	return h.txt, h.err
+}
+
+func (c *Checker) refresh(key string, h *checkerHost) {
+	txt, err := fetch(context.Background(), c.Client, key, c.UserAgent)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h.refreshing = false
+	h.expires = time.Now().Add(c.ttl(err))
+	if err == nil || h.err != nil {
+		h.txt, h.err = txt, err
+	}
+}
+
+// Allowed returns true if c.UserAgent can crawl u. False otherwise.
+// /robots.txt is always allowed. The error is the one of Txt, in which
+// case u is not allowed.
+func (c *Checker) Allowed(ctx context.Context, u *url.URL) (bool, error) {
+	if u.Path == "/robots.txt" {
+		return true, nil
+	}
+	txt, err := c.Txt(ctx, u)
+	if err != nil {
+		return false, err
+	}
+	return txt.Allowed(c.UserAgent, u.RequestURI()), nil
+}
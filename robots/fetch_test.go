@@ -0,0 +1,195 @@
+package robots_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"xojoc.pw/crawl/robots"
+)
+
+func TestFetch(t *testing.T) {
+	var status, redirects int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") == "" {
+			t.Error("missing User-Agent")
+		}
+		n := redirects
+		if r.URL.Path != "/robots.txt" {
+			n, _ = strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/r/"))
+		}
+		if n > 0 {
+			http.Redirect(w, r, "/r/"+strconv.Itoa(n-1), http.StatusFound)
+			return
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+			return
+		}
+		fmt.Fprint(w, "User-agent: *\nDisallow: /private/\n")
+	}))
+	defer ts.Close()
+
+	ctx := context.Background()
+	txt, err := robots.Fetch(ctx, nil, ts.URL)
+	if err != nil || txt.Allowed("bot", "/private/x") || !txt.Allowed("bot", "/public") {
+		t.Errorf("200: got %+v %v", txt, err)
+	}
+
+	for _, tt := range []struct {
+		status  int
+		allowed bool
+	}{
+		{http.StatusNotFound, true},
+		{http.StatusForbidden, true},
+		{http.StatusTooManyRequests, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusServiceUnavailable, false},
+	} {
+		status = tt.status
+		txt, err := robots.Fetch(ctx, nil, ts.URL)
+		if txt.Allowed("bot", "/public") != tt.allowed || (err != nil) == tt.allowed {
+			t.Errorf("%d: got %+v %v", tt.status, txt, err)
+		}
+	}
+	status = 0
+
+	txt, err = robots.Fetch(ctx, nil, "http://127.0.0.1:1")
+	if err == nil || txt.Allowed("bot", "/public") {
+		t.Errorf("unreachable host: got %+v %v", txt, err)
+	}
+
+	redirects = robots.MaxRedirects
+	txt, err = robots.Fetch(ctx, nil, ts.URL)
+	if err != nil || txt.Allowed("bot", "/private/x") {
+		t.Errorf("%d redirects: want the rules, got %+v %v", redirects, txt, err)
+	}
+	redirects = robots.MaxRedirects + 1
+	txt, err = robots.Fetch(ctx, nil, ts.URL)
+	if err != nil || !txt.Allowed("bot", "/private/x") {
+		t.Errorf("%d redirects: want allow all, got %+v %v", redirects, txt, err)
+	}
+}
+
+func TestChecker(t *testing.T) {
+	var hits, status int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		n := atomic.AddInt32(&hits, 1)
+		if s := atomic.LoadInt32(&status); s != 0 {
+			w.WriteHeader(int(s))
+			return
+		}
+		fmt.Fprintf(w, "User-agent: bot\nDisallow: /v%d/\n", n)
+	}))
+	defer ts.Close()
+
+	c := &robots.Checker{UserAgent: "Bot/1.0"}
+	ctx := context.Background()
+	parse := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	allowed := func(s string) bool {
+		ok, err := c.Allowed(ctx, parse(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if allowed(ts.URL+"/v1/x") || !allowed(ts.URL+"/v2/x") {
+		t.Error("want the rules of the first fetch")
+	}
+	if !allowed(ts.URL + "/robots.txt") {
+		t.Error("want /robots.txt allowed")
+	}
+	// the same origin
+	u := parse(ts.URL)
+	if allowed("HTTP://" + u.Host + "/v1/y") {
+		t.Error("want the cached rules")
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Fatalf("want 1 fetch, got %d", n)
+	}
+
+	// expired: the old rules are used while refreshing in the background
+	c = &robots.Checker{UserAgent: "bot", TTL: time.Nanosecond, ErrorTTL: time.Nanosecond}
+	rule := func() string {
+		txt, err := c.Txt(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := txt.Group("bot")
+		if g == nil || len(g.Disallow) == 0 {
+			return ""
+		}
+		return g.Disallow[0]
+	}
+	first := rule()
+	if first == "" {
+		t.Fatal("want rules")
+	}
+	waitFor(t, func() bool { return rule() != first })
+
+	// an unreachable robots.txt keeps the old rules
+	atomic.StoreInt32(&status, http.StatusInternalServerError)
+	n := atomic.LoadInt32(&hits)
+	waitFor(t, func() bool { return rule() != "" && atomic.LoadInt32(&hits) > n+2 })
+	if rule() == "/" {
+		t.Error("want the old rules on errors")
+	}
+
+	// an unreachable robots.txt never fetched is an error
+	c = &robots.Checker{UserAgent: "bot"}
+	if ok, err := c.Allowed(ctx, parse(ts.URL+"/anything")); ok || err == nil {
+		t.Errorf("want an error, got %v, %v", ok, err)
+	}
+	if ok, err := c.Allowed(ctx, parse(ts.URL+"/anything")); ok || err == nil {
+		t.Errorf("want the cached error, got %v, %v", ok, err)
+	}
+
+	// and is fetched again once expired
+	c = &robots.Checker{UserAgent: "bot", ErrorTTL: 50 * time.Millisecond}
+	if _, err := c.Txt(ctx, u); err == nil {
+		t.Error("want an error")
+	}
+	atomic.StoreInt32(&status, 0)
+	time.Sleep(60 * time.Millisecond)
+	if _, err := c.Txt(ctx, u); err != nil {
+		t.Errorf("want robots.txt fetched again, got %v", err)
+	}
+
+	// a cancelled fetch is an error and isn't cached
+	c = &robots.Checker{UserAgent: "bot"}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.Txt(cctx, u); err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+	if !allowed(ts.URL + "/anything") {
+		t.Error("want the rules fetched after the cancelled fetch")
+	}
+}
+
+func waitFor(t *testing.T, f func() bool) {
+	for i := 0; i < 100; i++ {
+		if f() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out")
+}
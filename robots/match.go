@@ -0,0 +1,120 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package robots
+
+import (
+	"strings"
+)
+
+const hex = "0123456789ABCDEF"
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// normalize puts a path, or a pattern, in a canonical form so that
+// equivalent ones compare equal: octets outside of printable US-ASCII are
+// percent-encoded, percent-encoded unreserved characters are decoded and
+// the hex digits of the others are upper case.
+func normalize(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' && i+2 < len(s) {
+			h, ok1 := unhex(s[i+1])
+			l, ok2 := unhex(s[i+2])
+			if ok1 && ok2 {
+				c = h<<4 | l
+				i += 2
+				if unreserved(c) {
+					b.WriteByte(c)
+				} else {
+					b.WriteByte('%')
+					b.WriteByte(hex[c>>4])
+					b.WriteByte(hex[c&15])
+				}
+				continue
+			}
+		}
+		if c <= ' ' || c >= 0x7f {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// match reports whether path matches pattern, where * matches any
+// sequence of characters and a final $ the end of path. Both must be
+// normalized.
+func match(pattern, path string) bool {
+	end := strings.HasSuffix(pattern, "$")
+	if end {
+		pattern = pattern[:len(pattern)-1]
+	}
+	parts := strings.Split(pattern, "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	path = path[len(parts[0]):]
+	if len(parts) == 1 {
+		return !end || path == ""
+	}
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(path, p)
+		if i < 0 {
+			return false
+		}
+		path = path[i+len(p):]
+	}
+	// the earliest match of each part leaves the most room for the last
+	last := parts[len(parts)-1]
+	if end {
+		return strings.HasSuffix(path, last)
+	}
+	return strings.Contains(path, last)
+}
+
+// longest returns the length of the longest of rules matching path, if
+// longer than n, or n.
+func longest(rules []string, path string, n int) int {
+	for _, r := range rules {
+		if r == "" {
+			continue
+		}
+		r = normalize(r)
+		if len(r) > n && match(r, path) {
+			n = len(r)
+		}
+	}
+	return n
+}
@@ -13,117 +13,298 @@ GNU Affero General Public License for more details.
 You should have received a copy of the GNU Affero General Public License
 along with this program.  If not, see <https://www.gnu.org/licenses/>. */
 
-// Package robots parses a robots.txt file as specified by Wikipedia https://en.wikipedia.org/wiki/Robots.txt
+// Package robots parses a robots.txt file as specified by RFC 9309
+// https://www.rfc-editor.org/rfc/rfc9309 and Wikipedia
+// https://en.wikipedia.org/wiki/Robots.txt
 package robots // import "xojoc.pw/crawl/robots"
 
 import (
-	"bufio"
 	"bytes"
+	"fmt"
 	"io"
-	"strconv"
+	"io/ioutil"
 	"strings"
+	"time"
 )
 
 // Txt contains the robots.txt rules.
 type Txt struct {
-	CrawlDelay map[string]int
-	Allow      map[string][]string
-	Disallow   map[string][]string
+	Groups []*Group
 
 	Sitemaps []string
+
+	// Warnings lists the problems found by Parse.
+	Warnings []Warning
 }
 
-// Allowed returns true if user agent ua can access path.
-// False otherwise.
-func (t *Txt) Allowed(ua string, path string) bool {
-	allowed := true
+// Warning is a problem found at line Line of a robots.txt file, like an
+// unknown directive. Line 0 refers to the whole file.
+type Warning struct {
+	Line int
+	Msg  string
+}
 
-	disallowedPath := ""
+func (w Warning) String() string {
+	return fmt.Sprintf("line %d: %s", w.Line, w.Msg)
+}
 
-	for _, d := range append(t.Disallow["*"], t.Disallow[ua]...) {
-		if d == "" {
-			allowed = true
-			disallowedPath = ""
-			continue
-		}
-		if strings.HasPrefix(path, d) {
-			if len(d) < len(disallowedPath) || disallowedPath == "" {
-				disallowedPath = d
-			}
-			allowed = false
-		}
+func (t *Txt) warn(line int, format string, args ...interface{}) {
+	t.Warnings = append(t.Warnings, Warning{Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Group contains the rules for the user agents in UserAgents.
+type Group struct {
+	UserAgents  []string
+	CrawlDelay  time.Duration
+	RequestRate Rate
+	VisitTimes  []VisitTime
+	Allow       []string
+	Disallow    []string
+}
 
+// ProductToken returns the product token of user agent ua, that is the
+// name before the version, lower case. For example "googlebot" for
+// "Googlebot/2.1 (+http://www.google.com/bot.html)".
+func ProductToken(ua string) string {
+	ua = strings.TrimSpace(ua)
+	if i := strings.IndexAny(ua, "/ \t"); i >= 0 {
+		ua = ua[:i]
 	}
-	for _, a := range append(t.Allow["*"], t.Allow[ua]...) {
-		if strings.HasPrefix(path, a) {
-			if len(a) > len(disallowedPath) {
-				allowed = true
+	return strings.ToLower(ua)
+}
+
+// Group returns the rules for user agent ua: those of the groups whose
+// name matches the product token of ua, ignoring case, combined. If there
+// are none, those of the * groups. Nil if there are neither.
+func (t *Txt) Group(ua string) *Group {
+	if t == nil {
+		return nil
+	}
+	tok := ProductToken(ua)
+	var g *Group
+	for _, star := range []bool{false, true} {
+		for _, gr := range t.Groups {
+			for _, a := range gr.UserAgents {
+				if star && a == "*" || !star && tok != "" && ProductToken(a) == tok {
+					g = g.merge(gr)
+					break
+				}
 			}
 		}
+		if g != nil {
+			break
+		}
+	}
+	return g
+}
+
+// merge returns the combination of g, which may be nil, and o.
+func (g *Group) merge(o *Group) *Group {
+	if g == nil {
+		g = &Group{}
 	}
+	g.UserAgents = append(g.UserAgents, o.UserAgents...)
+	if o.CrawlDelay > g.CrawlDelay {
+		g.CrawlDelay = o.CrawlDelay
+	}
+	if o.RequestRate.interval() > g.RequestRate.interval() {
+		g.RequestRate = o.RequestRate
+	}
+	g.VisitTimes = append(g.VisitTimes, o.VisitTimes...)
+	g.Allow = append(g.Allow, o.Allow...)
+	g.Disallow = append(g.Disallow, o.Disallow...)
+	return g
+}
 
-	return allowed
+// Allowed returns true if user agent ua can access path, which may
+// include the query. False otherwise.
+//
+// As in RFC 9309, * in a rule matches any sequence of characters and a
+// final $ the end of path. The rule matching the most characters wins and
+// Allow wins ties. An empty Disallow disallows nothing.
+func (t *Txt) Allowed(ua string, path string) bool {
+	g := t.Group(ua)
+	if g == nil {
+		return true
+	}
+	path = normalize(path)
+	return longest(g.Allow, path, -1) >= longest(g.Disallow, path, -1)
 }
 
-// Delay returns the number of seconds to wait between successive accesses to
-// the same host.
+// Delay returns the time to wait between successive accesses to the same
+// host: the longest of Crawl-delay and the interval given by Request-rate.
 // Returns 0 if no delay is specified.
-func (t *Txt) Delay(ua string) int {
-	if i, ok := t.CrawlDelay[ua]; ok {
-		return i
+func (t *Txt) Delay(ua string) time.Duration {
+	g := t.Group(ua)
+	if g == nil {
+		return 0
+	}
+	return g.delay()
+}
+
+// MaxSize is the size of the longest robots.txt file read by Parse. The
+// rest is ignored.
+const MaxSize = 500 << 10
+
+const (
+	userAgent   = "User-agent"
+	disallow    = "Disallow"
+	allow       = "Allow"
+	sitemap     = "Sitemap"
+	crawlDelay  = "Crawl-delay"
+	requestRate = "Request-rate"
+	visitTime   = "Visit-time"
+)
+
+// directives maps the directives, lower case and without - or _, to
+// their name.
+var directives = map[string]string{
+	"useragent":   userAgent,
+	"disallow":    disallow,
+	"allow":       allow,
+	"sitemap":     sitemap,
+	"crawldelay":  crawlDelay,
+	"requestrate": requestRate,
+	"visittime":   visitTime,
+}
+
+// misspellings maps the common misspellings of the directives, lower case
+// and without - or _, to their name.
+var misspellings = map[string]string{
+	"useragents":   userAgent,
+	"dissallow":    disallow,
+	"dissalow":     disallow,
+	"disalow":      disallow,
+	"disallows":    disallow,
+	"allows":       allow,
+	"sitemaps":     sitemap,
+	"crawldelays":  crawlDelay,
+	"delay":        crawlDelay,
+	"requestrates": requestRate,
+	"visittimes":   visitTime,
+}
+
+// split splits line l into its directive and value. It returns false if l
+// is not a known directive.
+func (t *Txt) split(n int, l string) (string, string, bool) {
+	i := strings.IndexByte(l, ':')
+	if i < 0 {
+		i = strings.IndexAny(l, " \t")
+		if i < 0 {
+			t.warn(n, "missing colon in %q", l)
+			return "", "", false
+		}
+		t.warn(n, "missing colon after %q", l[:i])
 	}
-	return t.CrawlDelay["*"]
+	k, v := strings.TrimSpace(l[:i]), strings.TrimSpace(l[i+1:])
+	key := strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "", "\t", "").Replace(k))
+	if d, ok := directives[key]; ok {
+		return d, v, true
+	}
+	if d, ok := misspellings[key]; ok {
+		t.warn(n, "%q misspelled as %q", d, k)
+		return d, v, true
+	}
+	t.warn(n, "unknown directive %q", k)
+	return "", "", false
 }
 
-// Parse parses a robots.txt file.
+// Parse parses a robots.txt file. It is lenient: it ignores a UTF-8 BOM,
+// blank space around directives and values, the case of directives,
+// comments, and accepts common misspellings and lines ending with CRLF
+// or CR. Problems are recorded in Txt.Warnings. It returns an error only if
+// reading r fails.
+//
+// Consecutive User-agent lines start a group, which holds the rules up to
+// the next User-agent line. Rules before the first group are ignored.
 func Parse(r io.Reader) (*Txt, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
 	txt := &Txt{}
-	txt.CrawlDelay = map[string]int{}
-	txt.Disallow = map[string][]string{}
-	txt.Allow = map[string][]string{}
-
-	buf := bufio.NewReader(r)
-	var ua string
-
-	lua := []byte("User-agent: ")
-	ldis := []byte("Disallow:")
-	lall := []byte("Allow: ")
-	lsm := []byte("Sitemap: ")
-	lcd := []byte("Crawl-delay: ")
-
-	for {
-		l, err := buf.ReadSlice('\n')
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, err
+	truncated := len(b) > MaxSize
+	if truncated {
+		b = b[:MaxSize]
+		// drop the partial last line
+		if i := bytes.LastIndexAny(b, "\r\n"); i >= 0 {
+			b = b[:i]
 		}
+	}
+	b = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	s := strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(string(b))
+	lines := strings.Split(s, "\n")
 
-		l = l[:len(l)-1]
+	var g *Group
+	// a User-agent line after a rule starts a new group
+	rules := true
+
+	for i, l := range lines {
+		n := i + 1
+		if j := strings.IndexByte(l, '#'); j >= 0 {
+			l = l[:j]
+		}
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		d, v, ok := txt.split(n, l)
+		if !ok {
+			continue
+		}
 
-		switch {
-		case bytes.HasPrefix(l, lua):
-			ua = string(l[len(lua):])
-		case bytes.HasPrefix(l, ldis):
-			dis := ""
-			if len(l) > len(ldis) {
-				dis = string(l[len(ldis)+1:])
+		switch d {
+		case userAgent:
+			if v == "" {
+				txt.warn(n, "empty User-agent")
+				continue
 			}
-			txt.Disallow[ua] = append(txt.Disallow[ua], dis)
-		case bytes.HasPrefix(l, lall):
-			txt.Allow[ua] = append(txt.Allow[ua], string(l[len(lall):]))
-		case bytes.HasPrefix(l, lcd):
-			i, err := strconv.Atoi(string(l[len(lcd):]))
-			if err == nil {
-				txt.CrawlDelay[ua] = i
+			if rules {
+				g = &Group{}
+				txt.Groups = append(txt.Groups, g)
+				rules = false
 			}
-		case bytes.HasPrefix(l, lsm):
-			txt.Sitemaps = append(txt.Sitemaps, string(l[len(lsm):]))
+			g.UserAgents = append(g.UserAgents, v)
+		case sitemap:
+			txt.Sitemaps = append(txt.Sitemaps, v)
 		default:
-			// skip line
+			rules = true
+			if g == nil {
+				txt.warn(n, "%s outside of a group", d)
+				continue
+			}
+			switch d {
+			case disallow:
+				g.Disallow = append(g.Disallow, v)
+			case allow:
+				g.Allow = append(g.Allow, v)
+			case crawlDelay:
+				d, err := parseDelay(v)
+				if err != nil {
+					txt.warn(n, "bad Crawl-delay %q", v)
+					continue
+				}
+				g.CrawlDelay = d
+			case requestRate:
+				r, err := parseRate(v)
+				if err != nil {
+					txt.warn(n, "bad Request-rate %q", v)
+					continue
+				}
+				g.RequestRate = r
+			case visitTime:
+				vt, err := parseVisitTime(v)
+				if err != nil {
+					txt.warn(n, "bad Visit-time %q", v)
+					continue
+				}
+				g.VisitTimes = append(g.VisitTimes, vt)
+			}
 		}
 	}
+	if truncated {
+		txt.warn(len(lines)+1, "file longer than %d bytes, rest ignored", MaxSize)
+	}
 
 	return txt, nil
 }
@@ -28,13 +28,11 @@ Sitemap: http://www.gnu.org/sitemap.xml
 	must.OK(err)
 
 	want := &robots.Txt{
-		CrawlDelay: map[string]int{
-			"*": 2,
-		},
-		Disallow: map[string][]string{
-			"*": []string{"/private/", "/savannah-checkouts/"},
-		},
-		Allow: map[string][]string{},
+		Groups: []*robots.Group{{
+			UserAgents: []string{"*"},
+			CrawlDelay: 2 * time.Second,
+			Disallow:   []string{"/private/", "/savannah-checkouts/"},
+		}},
 
 		Sitemaps: []string{"http://www.gnu.org/sitemap.xml"},
 	}
@@ -767,6 +765,240 @@ Disallow: /wiki/Category%3ANoindexed_pages
 	}
 }
 
+func TestAllowedRFC9309(t *testing.T) {
+	rf := `User-agent: *
+Disallow: /*.pdf$
+Disallow: /*?sessionid=
+Disallow: /private/
+Allow: /private/public
+Disallow: /fish*/salmon
+Allow: /tie
+Disallow: /tie
+Disallow: /%7euser/
+Disallow: /caf%c3%a9
+Disallow: /page
+Allow: /page$
+Disallow: /a%2fb
+`
+	txt, err := robots.Parse(strings.NewReader(rf))
+	must.OK(err)
+
+	tests := []struct {
+		path    string
+		allowed bool
+	}{
+		{"/", true},
+		{"/doc.pdf", false},
+		{"/dir/doc.pdf", false},
+		{"/doc.pdf?x=1", true},
+		{"/doc.pdfx", true},
+		{"/index?sessionid=1", false},
+		{"/index?a=1&sessionid=1", true},
+		{"/a/b?sessionid=2", false},
+		{"/private/", false},
+		{"/private/x", false},
+		{"/private/public", true},
+		{"/private/public/x", true},
+		{"/fish/salmon", false},
+		{"/fishes/salmon/x", false},
+		{"/fish/trout", true},
+		{"/tie", true},
+		{"/~user/x", false},
+		{"/%7Euser/x", false},
+		{"/café", false},
+		{"/caf%C3%A9", false},
+		{"/page", true},
+		{"/page2", false},
+		{"/a/b", true},
+		{"/a%2Fb", false},
+	}
+	for _, tt := range tests {
+		if got := txt.Allowed("bot", tt.path); got != tt.allowed {
+			t.Errorf("%s: want %v, got %v", tt.path, tt.allowed, got)
+		}
+	}
+}
+
+func TestGroups(t *testing.T) {
+	rf := `Disallow: /before-any-group
+
+User-agent: a
+User-agent: B
+Disallow: /x
+
+User-agent: *
+Disallow: /star
+Crawl-delay: 3
+
+User-agent: googlebot
+Disallow: /g1
+User-agent: c
+Allow: /c
+
+User-agent: Googlebot
+Disallow: /g2
+Crawl-delay: 1
+`
+	txt, err := robots.Parse(strings.NewReader(rf))
+	must.OK(err)
+
+	if len(txt.Groups) != 5 {
+		t.Fatalf("want 5 groups, got %d", len(txt.Groups))
+	}
+	tests := []struct {
+		ua      string
+		path    string
+		allowed bool
+	}{
+		{"a", "/x", false},
+		{"b", "/x", false},
+		{"A/1.0", "/x", false},
+		{"a", "/star", true},
+		{"a", "/before-any-group", true},
+		{"other", "/star", false},
+		{"other", "/x", true},
+		{"", "/star", false},
+		{"Googlebot/2.1 (+http://www.google.com/bot.html)", "/g1", false},
+		{"Googlebot/2.1 (+http://www.google.com/bot.html)", "/g2", false},
+		{"Googlebot/2.1 (+http://www.google.com/bot.html)", "/star", true},
+		{"c", "/g1", true},
+	}
+	for _, tt := range tests {
+		if got := txt.Allowed(tt.ua, tt.path); got != tt.allowed {
+			t.Errorf("%s %s: want %v, got %v", tt.ua, tt.path, tt.allowed, got)
+		}
+	}
+	if d := txt.Delay("Googlebot/2.1"); d != time.Second {
+		t.Errorf("want delay 1s, got %v", d)
+	}
+	if d := txt.Delay("a"); d != 0 {
+		t.Errorf("want delay 0, got %v", d)
+	}
+	if d := txt.Delay("other"); d != 3*time.Second {
+		t.Errorf("want delay 3s, got %v", d)
+	}
+}
+
+func TestParseLenient(t *testing.T) {
+	rf := "\xef\xbb\xbfuser-AGENT:a   # first\r\n" +
+		"  useragent :\tb\r\n" +
+		"DISALLOW:/x#comment\r\n" +
+		"Dissallow: /y\r" +
+		"allow /x/ok\n" +
+		"Noindex: /z\n" +
+		"Crawl-delay: soon\n" +
+		"Sitemap: http://example.com/sitemap.xml\n" +
+		"Disallow: /last"
+	got, err := robots.Parse(strings.NewReader(rf))
+	must.OK(err)
+
+	want := &robots.Txt{
+		Groups: []*robots.Group{{
+			UserAgents: []string{"a", "b"},
+			Disallow:   []string{"/x", "/y", "/last"},
+			Allow:      []string{"/x/ok"},
+		}},
+		Sitemaps: []string{"http://example.com/sitemap.xml"},
+		Warnings: []robots.Warning{
+			{4, `"Disallow" misspelled as "Dissallow"`},
+			{5, `missing colon after "allow"`},
+			{6, `unknown directive "Noindex"`},
+			{7, `bad Crawl-delay "soon"`},
+		},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("# want:\n%#v\n\n# got:\n%#v\n", want, got)
+	}
+
+	big := "User-agent: *\nDisallow: /a\n" + strings.Repeat("# padding\n", robots.MaxSize/10) + "Disallow: /b\n"
+	got, err = robots.Parse(strings.NewReader(big))
+	must.OK(err)
+	if !got.Allowed("bot", "/b") || got.Allowed("bot", "/a") {
+		t.Errorf("want the rules after %d bytes ignored", robots.MaxSize)
+	}
+	if len(got.Warnings) != 1 || got.Warnings[0].Line == 0 {
+		t.Errorf("want a truncation warning, got %v", got.Warnings)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	rf := `User-agent: half
+Crawl-delay: 0.5
+
+User-agent: rate
+Crawl-delay: 2
+Request-rate: 1/10s
+
+User-agent: slow
+Request-rate: 3/1m
+Crawl-delay: 1
+
+User-agent: night
+Crawl-delay: 60
+Visit-time: 2200-0200
+Visit-time: 0600-0845
+
+User-agent: bad
+Crawl-delay: -1
+Request-rate: 1/0
+Request-rate: x/10
+Visit-time: 0600-2500
+`
+	txt, err := robots.Parse(strings.NewReader(rf))
+	must.OK(err)
+
+	for ua, want := range map[string]time.Duration{
+		"half":  500 * time.Millisecond,
+		"rate":  10 * time.Second,
+		"slow":  20 * time.Second,
+		"night": time.Minute,
+		"bad":   0,
+	} {
+		if d := txt.Delay(ua); d != want {
+			t.Errorf("%s: want %v, got %v", ua, want, d)
+		}
+	}
+	if g := txt.Group("rate"); g.RequestRate != (robots.Rate{Requests: 1, Per: 10 * time.Second}) {
+		t.Errorf("got %+v", g.RequestRate)
+	}
+	if g := txt.Group("night"); !reflect.DeepEqual(g.VisitTimes, []robots.VisitTime{
+		{Start: 22 * time.Hour, End: 2 * time.Hour},
+		{Start: 6 * time.Hour, End: 8*time.Hour + 45*time.Minute},
+	}) {
+		t.Errorf("got %+v", g.VisitTimes)
+	}
+	if len(txt.Warnings) != 4 {
+		t.Errorf("want 4 warnings, got %v", txt.Warnings)
+	}
+
+	at := func(h, m int) time.Time {
+		return time.Date(2018, 1, 2, h, m, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		ua    string
+		last  time.Time
+		delay time.Duration
+		want  time.Time
+	}{
+		{"rate", at(10, 0), 0, at(10, 0).Add(10 * time.Second)},
+		{"rate", at(10, 0), time.Minute, at(10, 1)},
+		{"other", at(10, 0), time.Second, at(10, 0).Add(time.Second)},
+		{"night", at(7, 0), 0, at(7, 1)},
+		{"night", at(8, 44), 0, at(8, 45).Add(13*time.Hour + 15*time.Minute)},
+		{"night", at(23, 30), 0, at(23, 31)},
+		{"night", at(1, 59), 0, at(6, 0)},
+		{"night", at(12, 0), 0, at(22, 0)},
+	}
+	for _, tt := range tests {
+		if got := txt.Next(tt.ua, tt.last, tt.delay); !got.Equal(tt.want) {
+			t.Errorf("%s after %v: want %v, got %v", tt.ua, tt.last, tt.want, got)
+		}
+	}
+	if got := txt.Next("rate", time.Time{}, time.Hour); got.After(time.Now()) {
+		t.Errorf("first access: want now, got %v", got)
+	}
+}
+
 var cfg = &quick.Config{MaxCount: 100000, Rand: rand.New(rand.NewSource(time.Now().UTC().UnixNano()))}
 
 func TestQuick(t *testing.T) {
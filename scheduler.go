@@ -0,0 +1,267 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package crawl
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+
+	"xojoc.pw/crawl/urlnorm"
+)
+
+// ErrDone is returned by Scheduler.Next when no URL is queued and none is
+// in flight.
+var ErrDone = errors.New("crawl: scheduler is empty")
+
+// Scheduler keeps one queue per host and releases an entry for a host only
+// after the host's delay has elapsed since the previous release and while
+// the host has less than MaxConns entries in flight. Hosts are named by
+// HostKey, so Example.com and example.com:80 share a queue.
+// The zero value is ready to use.
+type Scheduler struct {
+	// DefaultDelay is used for hosts without a delay set with SetDelay.
+	DefaultDelay time.Duration
+	// MaxConns is the maximum number of entries in flight per host.
+	// Defaults to 1.
+	MaxConns int
+
+	mu       sync.Mutex
+	hosts    map[string]*hostQueue
+	ready    hostHeap
+	queued   int
+	inflight int
+	wake     chan struct{}
+}
+
+type hostQueue struct {
+	queue  []*Entry
+	active int
+	delay  time.Duration
+	hasDel bool
+	nextFn func(last time.Time) time.Time
+	last   time.Time
+	next   time.Time
+	index  int // in ready, -1 if not there
+}
+
+type hostHeap []*hostQueue
+
+func (h hostHeap) Len() int           { return len(h) }
+func (h hostHeap) Less(i, j int) bool { return h[i].next.Before(h[j].next) }
+func (h hostHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *hostHeap) Push(x interface{}) {
+	q := x.(*hostQueue)
+	q.index = len(*h)
+	*h = append(*h, q)
+}
+func (h *hostHeap) Pop() interface{} {
+	old := *h
+	q := old[len(old)-1]
+	*h = old[:len(old)-1]
+	q.index = -1
+	return q
+}
+
+// HostKey returns the host of u in lower case and without the default
+// port of its scheme.
+func HostKey(u *url.URL) string {
+	n := urlnorm.Normalize(&url.URL{Scheme: u.Scheme, Host: u.Host}, urlnorm.LowercaseScheme|urlnorm.LowercaseHost|urlnorm.RemoveDefaultPort)
+	return n.Host
+}
+
+func (s *Scheduler) maxConns() int {
+	if s.MaxConns <= 0 {
+		return 1
+	}
+	return s.MaxConns
+}
+
+func (s *Scheduler) host(name string) *hostQueue {
+	if s.hosts == nil {
+		s.hosts = map[string]*hostQueue{}
+	}
+	q, ok := s.hosts[name]
+	if !ok {
+		q = &hostQueue{index: -1}
+		s.hosts[name] = q
+	}
+	return q
+}
+
+// fix puts q in the ready heap if it has work and a free connection,
+// removes it otherwise.
+func (s *Scheduler) fix(q *hostQueue) {
+	eligible := len(q.queue) > 0 && q.active < s.maxConns()
+	switch {
+	case eligible && q.index < 0:
+		heap.Push(&s.ready, q)
+	case eligible:
+		heap.Fix(&s.ready, q.index)
+	case q.index >= 0:
+		heap.Remove(&s.ready, q.index)
+	}
+}
+
+// signal wakes up every goroutine blocked in Next.
+func (s *Scheduler) signal() {
+	if s.wake != nil {
+		close(s.wake)
+		s.wake = nil
+	}
+}
+
+// Push queues e behind the other entries of the same host.
+func (s *Scheduler) Push(e *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.host(HostKey(e.URL))
+	q.queue = append(q.queue, e)
+	s.queued++
+	s.fix(q)
+	s.signal()
+}
+
+// Retry queues e, returned by Next, again in front of the other entries
+// of its host and holds the host until at. The caller still calls Done.
+func (s *Scheduler) Retry(e *Entry, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.host(HostKey(e.URL))
+	q.queue = append([]*Entry{e}, q.queue...)
+	s.queued++
+	if at.After(q.next) {
+		q.next = at
+	}
+	s.fix(q)
+	s.signal()
+}
+
+// SetDelay sets the minimum time between two releases for host, as
+// returned by HostKey.
+func (s *Scheduler) SetDelay(host string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.host(host)
+	q.delay = d
+	q.hasDel = true
+	if !q.last.IsZero() {
+		q.next = q.last.Add(d)
+	}
+	s.fix(q)
+	s.signal()
+}
+
+// SetNext sets next to compute when host, as returned by HostKey, can be
+// released, instead of its delay: after a release at last, or for the
+// first time if last is zero. It is meant for schedules like
+// robots.Txt.Next.
+func (s *Scheduler) SetNext(host string, next func(last time.Time) time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.host(host)
+	q.nextFn = next
+	if next != nil {
+		q.next = next(q.last)
+	}
+	s.fix(q)
+	s.signal()
+}
+
+// Next blocks until an entry can be fetched and returns it. The caller must
+// call Done once the entry has been processed.
+// Next returns ErrDone if nothing is queued or in flight, or ctx.Err() if
+// ctx is cancelled.
+func (s *Scheduler) Next(ctx context.Context) (*Entry, error) {
+	for {
+		s.mu.Lock()
+		if err := ctx.Err(); err != nil {
+			s.mu.Unlock()
+			return nil, err
+		}
+		if s.queued == 0 && s.inflight == 0 {
+			s.signal()
+			s.mu.Unlock()
+			return nil, ErrDone
+		}
+		var timer *time.Timer
+		var wait <-chan time.Time
+		if len(s.ready) > 0 {
+			q := s.ready[0]
+			now := time.Now()
+			if !q.next.After(now) {
+				e := q.queue[0]
+				q.queue = q.queue[1:]
+				q.active++
+				q.last = now
+				d := s.DefaultDelay
+				if q.hasDel {
+					d = q.delay
+				}
+				q.next = now.Add(d)
+				if q.nextFn != nil {
+					q.next = q.nextFn(now)
+				}
+				s.queued--
+				s.inflight++
+				s.fix(q)
+				s.mu.Unlock()
+				return e, nil
+			}
+			timer = time.NewTimer(q.next.Sub(now))
+			wait = timer.C
+		}
+		if s.wake == nil {
+			s.wake = make(chan struct{})
+		}
+		wake := s.wake
+		s.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-wait:
+		case <-ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Done marks e, returned by Next, as processed.
+func (s *Scheduler) Done(e *Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.host(HostKey(e.URL))
+	q.active--
+	s.inflight--
+	s.fix(q)
+	s.signal()
+}
+
+// Len returns the number of queued entries.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queued
+}
@@ -0,0 +1,133 @@
+package crawl_test
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"xojoc.pw/crawl"
+)
+
+func entry(s string) *crawl.Entry {
+	u, err := url.Parse(s)
+	if err != nil {
+		panic(err)
+	}
+	return &crawl.Entry{URL: u}
+}
+
+func TestScheduler(t *testing.T) {
+	s := &crawl.Scheduler{}
+	s.SetDelay("a", 50*time.Millisecond)
+	s.Push(entry("http://a/1"))
+	s.Push(entry("http://a/2"))
+	s.Push(entry("http://b/1"))
+
+	ctx := context.Background()
+	start := time.Now()
+
+	e1, _ := s.Next(ctx)
+	e2, _ := s.Next(ctx)
+	if e1.URL.Host == e2.URL.Host {
+		t.Fatalf("two entries of host %s released at once", e1.URL.Host)
+	}
+	s.Done(e1)
+	s.Done(e2)
+
+	e3, _ := s.Next(ctx)
+	if e3.URL.String() != "http://a/2" {
+		t.Fatalf("want http://a/2, got %s", e3.URL)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("host a released after %s", d)
+	}
+	s.Done(e3)
+
+	if _, err := s.Next(ctx); err != crawl.ErrDone {
+		t.Errorf("want %v, got %v", crawl.ErrDone, err)
+	}
+}
+
+func TestScheduler_Retry(t *testing.T) {
+	s := &crawl.Scheduler{}
+	s.Push(entry("http://a/1"))
+	s.Push(entry("http://a/2"))
+	ctx := context.Background()
+	start := time.Now()
+
+	e, _ := s.Next(ctx)
+	s.Retry(e, start.Add(50*time.Millisecond))
+	s.Done(e)
+	e, _ = s.Next(ctx)
+	if e.URL.String() != "http://a/1" {
+		t.Fatalf("want http://a/1, got %s", e.URL)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("retried after %s", d)
+	}
+}
+
+func TestScheduler_HostKey(t *testing.T) {
+	s := &crawl.Scheduler{}
+	s.SetDelay("example.com", time.Hour)
+	s.Push(entry("http://Example.com/1"))
+	s.Push(entry("http://example.com:80/2"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	e, err := s.Next(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Done(e)
+	if e, err := s.Next(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want the two URLs in the same queue, got %v %v", e, err)
+	}
+	if k := crawl.HostKey(entry("https://EXAMPLE.com:443/").URL); k != "example.com" {
+		t.Errorf("HostKey: got %q", k)
+	}
+}
+
+func TestScheduler_MaxConns(t *testing.T) {
+	s := &crawl.Scheduler{MaxConns: 2}
+	for i := 0; i < 3; i++ {
+		s.Push(entry("http://a/"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	s.Next(ctx)
+	s.Next(ctx)
+	if _, err := s.Next(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestScheduler_SetNext(t *testing.T) {
+	s := &crawl.Scheduler{}
+	start := time.Now()
+	var lasts []time.Time
+	s.SetNext("a", func(last time.Time) time.Time {
+		lasts = append(lasts, last)
+		if last.IsZero() {
+			return start.Add(30 * time.Millisecond)
+		}
+		return last.Add(20 * time.Millisecond)
+	})
+	s.Push(entry("http://a/1"))
+	s.Push(entry("http://a/2"))
+
+	ctx := context.Background()
+	e, _ := s.Next(ctx)
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("first release after %s", d)
+	}
+	s.Done(e)
+	e, _ = s.Next(ctx)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("second release after %s", d)
+	}
+	s.Done(e)
+	if len(lasts) != 3 || !lasts[0].IsZero() || lasts[1].IsZero() {
+		t.Errorf("got calls with %v", lasts)
+	}
+}
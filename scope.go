@@ -0,0 +1,198 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package crawl
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Scope decides which entries are crawled.
+// Check returns nil if e is in scope, otherwise an error telling why e
+// was rejected.
+type Scope interface {
+	Check(e *Entry) error
+}
+
+// ScopeFunc is a function used as a Scope.
+type ScopeFunc func(e *Entry) error
+
+func (f ScopeFunc) Check(e *Entry) error {
+	return f(e)
+}
+
+type and []Scope
+
+// And returns a Scope that accepts an entry only if all the scopes accept
+// it. The scopes are checked in order and the first rejection is returned.
+func And(scopes ...Scope) Scope {
+	return and(scopes)
+}
+
+func (a and) Check(e *Entry) error {
+	for _, s := range a {
+		if err := s.Check(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type or []Scope
+
+// Or returns a Scope that accepts an entry if any of the scopes accepts it.
+func Or(scopes ...Scope) Scope {
+	return or(scopes)
+}
+
+func (o or) Check(e *Entry) error {
+	var why []string
+	for _, s := range o {
+		err := s.Check(e)
+		if err == nil {
+			return nil
+		}
+		why = append(why, err.Error())
+	}
+	return errors.New(strings.Join(why, "; "))
+}
+
+func seed(e *Entry) *url.URL {
+	if e.Seed == "" {
+		return e.URL
+	}
+	s, err := url.Parse(e.Seed)
+	if err != nil {
+		return e.URL
+	}
+	return s
+}
+
+// SameHost accepts entries with the same host as their seed.
+func SameHost() Scope {
+	return ScopeFunc(func(e *Entry) error {
+		s := seed(e)
+		if !strings.EqualFold(e.URL.Hostname(), s.Hostname()) {
+			return fmt.Errorf("host %s is not %s", e.URL.Hostname(), s.Hostname())
+		}
+		return nil
+	})
+}
+
+func domain(host string) string {
+	host = strings.ToLower(host)
+	d, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return d
+}
+
+// SameDomain accepts entries with the same registrable domain as their
+// seed, so that www.example.com and blog.example.com are in the same scope.
+func SameDomain() Scope {
+	return ScopeFunc(func(e *Entry) error {
+		d, sd := domain(e.URL.Hostname()), domain(seed(e).Hostname())
+		if d != sd {
+			return fmt.Errorf("domain %s is not %s", d, sd)
+		}
+		return nil
+	})
+}
+
+// Prefix accepts entries whose URL starts with one of prefixes.
+func Prefix(prefixes ...string) Scope {
+	return ScopeFunc(func(e *Entry) error {
+		u := e.URL.String()
+		for _, p := range prefixes {
+			if strings.HasPrefix(u, p) {
+				return nil
+			}
+		}
+		return fmt.Errorf("no prefix %q", prefixes)
+	})
+}
+
+// Include accepts entries whose URL matches re.
+func Include(re *regexp.Regexp) Scope {
+	return ScopeFunc(func(e *Entry) error {
+		if !re.MatchString(e.URL.String()) {
+			return fmt.Errorf("doesn't match %s", re)
+		}
+		return nil
+	})
+}
+
+// Exclude rejects entries whose URL matches re.
+func Exclude(re *regexp.Regexp) Scope {
+	return ScopeFunc(func(e *Entry) error {
+		if re.MatchString(e.URL.String()) {
+			return fmt.Errorf("matches %s", re)
+		}
+		return nil
+	})
+}
+
+// MaxDepth accepts entries at most n links away from their seed.
+func MaxDepth(n int) Scope {
+	return ScopeFunc(func(e *Entry) error {
+		if e.Depth > n {
+			return fmt.Errorf("depth %d is more than %d", e.Depth, n)
+		}
+		return nil
+	})
+}
+
+// MaxPagesPerHost accepts the first n entries of each host.
+// Since it counts every entry it accepts, put it last in an And.
+func MaxPagesPerHost(n int) Scope {
+	var mu sync.Mutex
+	pages := map[string]int{}
+	return ScopeFunc(func(e *Entry) error {
+		h := strings.ToLower(e.URL.Host)
+		mu.Lock()
+		defer mu.Unlock()
+		if pages[h] >= n {
+			return fmt.Errorf("more than %d pages for %s", n, h)
+		}
+		pages[h]++
+		return nil
+	})
+}
+
+// Extensions accepts entries whose path has one of the file extensions
+// exts, given with the leading dot, or no extension at all.
+func Extensions(exts ...string) Scope {
+	return ScopeFunc(func(e *Entry) error {
+		ext := strings.ToLower(path.Ext(e.URL.Path))
+		if ext == "" {
+			return nil
+		}
+		for _, x := range exts {
+			if ext == strings.ToLower(x) {
+				return nil
+			}
+		}
+		return fmt.Errorf("extension %s not allowed", ext)
+	})
+}
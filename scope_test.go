@@ -0,0 +1,55 @@
+package crawl_test
+
+import (
+	"regexp"
+	"testing"
+
+	"xojoc.pw/crawl"
+)
+
+func TestScope(t *testing.T) {
+	tests := []struct {
+		scope crawl.Scope
+		url   string
+		seed  string
+		depth int
+		ok    bool
+	}{
+		{crawl.SameHost(), "http://a.com/x", "http://A.com/", 0, true},
+		{crawl.SameHost(), "http://b.a.com/x", "http://a.com/", 0, false},
+		{crawl.SameDomain(), "http://b.a.co.uk/x", "http://www.a.co.uk/", 0, true},
+		{crawl.SameDomain(), "http://b.co.uk/x", "http://a.co.uk/", 0, false},
+		{crawl.Prefix("http://a.com/doc/"), "http://a.com/doc/x", "", 0, true},
+		{crawl.Prefix("http://a.com/doc/"), "http://a.com/x", "", 0, false},
+		{crawl.Include(regexp.MustCompile(`\d+$`)), "http://a.com/1", "", 0, true},
+		{crawl.Exclude(regexp.MustCompile(`\d+$`)), "http://a.com/1", "", 0, false},
+		{crawl.MaxDepth(2), "http://a.com/", "", 2, true},
+		{crawl.MaxDepth(2), "http://a.com/", "", 3, false},
+		{crawl.Extensions(".html", ".PDF"), "http://a.com/x.pdf", "", 0, true},
+		{crawl.Extensions(".html"), "http://a.com/x/", "", 0, true},
+		{crawl.Extensions(".html"), "http://a.com/x.jpg", "", 0, false},
+		{crawl.Or(crawl.MaxDepth(0), crawl.SameHost()), "http://a.com/", "http://a.com/", 5, true},
+		{crawl.Or(crawl.MaxDepth(0), crawl.SameHost()), "http://b.com/", "http://a.com/", 5, false},
+		{crawl.And(crawl.MaxDepth(9), crawl.SameHost()), "http://b.com/", "http://a.com/", 5, false},
+	}
+	for _, tt := range tests {
+		e := entry(tt.url)
+		e.Seed, e.Depth = tt.seed, tt.depth
+		err := tt.scope.Check(e)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s (seed %q, depth %d): want %v, got %v", tt.url, tt.seed, tt.depth, tt.ok, err)
+		}
+	}
+}
+
+func TestMaxPagesPerHost(t *testing.T) {
+	s := crawl.MaxPagesPerHost(2)
+	for i, ok := range []bool{true, true, false} {
+		if err := s.Check(entry("http://a.com/")); (err == nil) != ok {
+			t.Errorf("%d: want %v, got %v", i, ok, err)
+		}
+	}
+	if err := s.Check(entry("http://b.com/")); err != nil {
+		t.Error(err)
+	}
+}
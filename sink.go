@@ -0,0 +1,65 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package crawl
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"xojoc.pw/crawl/warc"
+)
+
+// WARCSink returns a function, to use as Crawler.Handle or to call from it,
+// writing each fetched page to w: a response record, the request record
+// and a metadata record with the outlinks, if any, all for the final URL
+// if Crawler.Fetch followed redirects. Pages not fetched are skipped.
+func WARCSink(w *warc.Writer) func(*Page) error {
+	return func(p *Page) error {
+		if p.Err != nil || p.Response == nil {
+			return nil
+		}
+		u := p.URL.String()
+		if req := p.Response.Request; req != nil && req.URL != nil {
+			u = req.URL.String()
+		}
+		date := time.Now()
+		r := *p.Response
+		r.Body = ioutil.NopCloser(bytes.NewReader(p.Body))
+		id, err := w.WriteResponse(u, date, &r)
+		if err != nil {
+			return err
+		}
+		if req := p.Response.Request; req != nil {
+			_, err = w.WriteRequest(u, date, req, id)
+			if err != nil {
+				return err
+			}
+		}
+		if len(p.Links) == 0 {
+			return nil
+		}
+		var block bytes.Buffer
+		for _, l := range p.Links {
+			fmt.Fprintf(&block, "outlink: %s %s\r\n", l.URL, l.Kind)
+		}
+		m := &warc.Record{Type: warc.Metadata, Date: date, TargetURI: u, ContentType: warc.Fields, Block: block.Bytes()}
+		m.Set("WARC-Concurrent-To", id)
+		_, err = w.Write(m)
+		return err
+	}
+}
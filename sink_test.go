@@ -0,0 +1,83 @@
+package crawl_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"xojoc.pw/crawl"
+	"xojoc.pw/crawl/warc"
+)
+
+func TestWARCSink(t *testing.T) {
+	ts := site()
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	c := &crawl.Crawler{
+		Seeds:  []string{ts.URL + "/"},
+		Handle: crawl.WARCSink(warc.NewWriter(&buf)),
+	}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	count := map[string]int{}
+	r := warc.NewReader(&buf)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count[rec.Type]++
+		if rec.Type == warc.Metadata && rec.TargetURI == ts.URL+"/" &&
+			!strings.Contains(string(rec.Block), "outlink: "+ts.URL+"/a a\r\n") {
+			t.Errorf("missing outlink: %q", rec.Block)
+		}
+	}
+	// robots.txt is not a page
+	if count[warc.Response] != 3 || count[warc.Request] != 3 || count[warc.Metadata] != 2 {
+		t.Errorf("got %v", count)
+	}
+}
+
+func TestWARCSink_Redirect(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusFound)
+			return
+		}
+		w.Write([]byte("page"))
+	}))
+	defer ts.Close()
+
+	var buf bytes.Buffer
+	c := &crawl.Crawler{
+		Seeds:  []string{ts.URL + "/old"},
+		Fetch:  http.DefaultClient.Do,
+		Handle: crawl.WARCSink(warc.NewWriter(&buf)),
+	}
+	if err := c.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	r := warc.NewReader(&buf)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.TargetURI != ts.URL+"/new" {
+			t.Errorf("%s record for %s", rec.Type, rec.TargetURI)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+// Package urlnorm normalizes URLs so that equivalent URLs compare equal.
+// See RFC 3986 section 6.
+package urlnorm // import "xojoc.pw/crawl/urlnorm"
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Flags select the normalizations to apply.
+type Flags uint
+
+const (
+	// LowercaseScheme turns HTTP://a into http://a.
+	LowercaseScheme Flags = 1 << iota
+	// LowercaseHost turns http://Example.com into http://example.com.
+	LowercaseHost
+	// RemoveDefaultPort turns http://a:80/ into http://a/.
+	RemoveDefaultPort
+	// RemoveDotSegments turns http://a/b/../c/./d into http://a/c/d.
+	RemoveDotSegments
+	// NormalizeEscapes uppercases percent-encodings and decodes the ones of
+	// unreserved characters: %7e%2f becomes ~%2F.
+	NormalizeEscapes
+	// RemoveFragment turns http://a/#x into http://a/.
+	RemoveFragment
+	// RemoveEmptyQuery turns http://a/? into http://a/.
+	RemoveEmptyQuery
+	// SortQuery sorts the query parameters by key.
+	SortQuery
+	// RemoveTrackingParams removes the query parameters matching
+	// TrackingParams.
+	RemoveTrackingParams
+	// AddRootPath turns http://a into http://a/.
+	AddRootPath
+
+	// Default are the normalizations that don't change the resource
+	// a URL points to on well behaved servers.
+	Default = LowercaseScheme | LowercaseHost | RemoveDefaultPort |
+		RemoveDotSegments | NormalizeEscapes | RemoveFragment |
+		RemoveEmptyQuery | SortQuery | RemoveTrackingParams | AddRootPath
+)
+
+// TrackingParams are the query parameters removed by RemoveTrackingParams.
+// A trailing * matches any suffix.
+var TrackingParams = []string{
+	"utm_*",
+	"gclid",
+	"dclid",
+	"fbclid",
+	"msclkid",
+	"yclid",
+	"mc_cid",
+	"mc_eid",
+	"_ga",
+	"_hsenc",
+	"_hsmi",
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+}
+
+// Normalize returns a normalized copy of u.
+func Normalize(u *url.URL, f Flags) *url.URL {
+	n := *u
+	if n.User != nil {
+		ui := *n.User
+		n.User = &ui
+	}
+	u = &n
+
+	if f&LowercaseScheme != 0 {
+		u.Scheme = strings.ToLower(u.Scheme)
+	}
+	if u.Opaque != "" {
+		if f&RemoveFragment != 0 {
+			u.Fragment = ""
+			u.RawFragment = ""
+		}
+		return u
+	}
+	if f&LowercaseHost != 0 {
+		u.Host = strings.ToLower(u.Host)
+	}
+	if f&RemoveDefaultPort != 0 {
+		h, p := splitPort(u.Host)
+		if p == "" || p == defaultPorts[strings.ToLower(u.Scheme)] {
+			u.Host = h
+		}
+	}
+
+	p := u.EscapedPath()
+	if f&NormalizeEscapes != 0 {
+		p = normalizeEscapes(p)
+	}
+	if f&RemoveDotSegments != 0 {
+		p = removeDotSegments(p)
+	}
+	if f&AddRootPath != 0 && p == "" && u.Host != "" {
+		p = "/"
+	}
+	setPath(u, p)
+
+	q := u.RawQuery
+	if f&NormalizeEscapes != 0 {
+		q = normalizeEscapes(q)
+	}
+	if f&(SortQuery|RemoveTrackingParams) != 0 && q != "" {
+		q = query(q, f)
+	}
+	u.RawQuery = q
+	if f&RemoveEmptyQuery != 0 && q == "" {
+		u.ForceQuery = false
+	}
+
+	if f&RemoveFragment != 0 {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+	return u
+}
+
+// String parses s and returns it normalized.
+func String(s string, f Flags) (string, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", err
+	}
+	return Normalize(u, f).String(), nil
+}
+
+func splitPort(host string) (string, string) {
+	i := strings.LastIndexByte(host, ':')
+	if i < 0 || strings.IndexByte(host[i:], ']') >= 0 {
+		return host, ""
+	}
+	return host[:i], host[i+1:]
+}
+
+func setPath(u *url.URL, p string) {
+	path, err := url.PathUnescape(p)
+	if err != nil {
+		return
+	}
+	u.Path = path
+	u.RawPath = p
+	if u.EscapedPath() != p {
+		// p is the default encoding of path
+		u.RawPath = ""
+	}
+}
+
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func normalizeEscapes(s string) string {
+	if strings.IndexByte(s, '%') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) {
+			h, ok1 := unhex(s[i+1])
+			l, ok2 := unhex(s[i+2])
+			if ok1 && ok2 {
+				c := h<<4 | l
+				if unreserved(c) {
+					b.WriteByte(c)
+				} else {
+					b.WriteByte('%')
+					b.WriteString(strings.ToUpper(s[i+1 : i+3]))
+				}
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// removeDotSegments implements RFC 3986 section 5.2.4.
+func removeDotSegments(p string) string {
+	if !strings.Contains(p, ".") {
+		return p
+	}
+	var out []string
+	segs := strings.Split(p, "/")
+	for i, s := range segs {
+		last := i == len(segs)-1
+		switch s {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, s)
+		}
+	}
+	r := strings.Join(out, "/")
+	if strings.HasPrefix(p, "/") && !strings.HasPrefix(r, "/") {
+		r = "/" + r
+	}
+	return r
+}
+
+func tracking(k string) bool {
+	k = strings.ToLower(k)
+	for _, t := range TrackingParams {
+		if strings.HasSuffix(t, "*") {
+			if strings.HasPrefix(k, t[:len(t)-1]) {
+				return true
+			}
+		} else if k == t {
+			return true
+		}
+	}
+	return false
+}
+
+func query(q string, f Flags) string {
+	type param struct {
+		key string
+		raw string
+	}
+	var ps []param
+	for _, raw := range strings.Split(q, "&") {
+		if raw == "" {
+			continue
+		}
+		k := raw
+		if i := strings.IndexByte(k, '='); i >= 0 {
+			k = k[:i]
+		}
+		if uk, err := url.QueryUnescape(k); err == nil {
+			k = uk
+		}
+		if f&RemoveTrackingParams != 0 && tracking(k) {
+			continue
+		}
+		ps = append(ps, param{k, raw})
+	}
+	if f&SortQuery != 0 {
+		sort.SliceStable(ps, func(i, j int) bool { return ps[i].key < ps[j].key })
+	}
+	raws := make([]string, len(ps))
+	for i, p := range ps {
+		raws[i] = p.raw
+	}
+	return strings.Join(raws, "&")
+}
@@ -0,0 +1,43 @@
+package urlnorm_test
+
+import (
+	"testing"
+
+	"xojoc.pw/crawl/urlnorm"
+)
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		in    string
+		flags urlnorm.Flags
+		want  string
+	}{
+		{"http://Example.com/a/../b?", urlnorm.Default, "http://example.com/b"},
+		{"http://example.com/b", urlnorm.Default, "http://example.com/b"},
+		{"http://example.com:80/b#x", urlnorm.Default, "http://example.com/b"},
+		{"HTTPS://example.com:443", urlnorm.Default, "https://example.com/"},
+		{"https://example.com:8443/", urlnorm.Default, "https://example.com:8443/"},
+		{"http://[::1]:80/", urlnorm.Default, "http://[::1]/"},
+		{"http://a/b/c/./../../g", urlnorm.Default, "http://a/g"},
+		{"http://a/b/..", urlnorm.Default, "http://a/"},
+		{"http://a/%7efoo%2fbar%3a", urlnorm.Default, "http://a/~foo%2Fbar%3A"},
+		{"http://a/?b=2&a=1&a=0", urlnorm.Default, "http://a/?a=1&a=0&b=2"},
+		{"http://a/?utm_source=x&id=1&gclid=y&UTM_medium=z", urlnorm.Default, "http://a/?id=1"},
+		{"http://a/?q=%7e", urlnorm.Default, "http://a/?q=~"},
+		{"mailto:Someone@Example.com", urlnorm.Default, "mailto:Someone@Example.com"},
+
+		{"http://Example.com:80/a/../b?z=1&a=2#x", urlnorm.LowercaseHost, "http://example.com:80/a/../b?z=1&a=2#x"},
+		{"http://a/b?z=1&a=2#x", urlnorm.SortQuery, "http://a/b?a=2&z=1#x"},
+		{"http://a/b?", urlnorm.RemoveFragment, "http://a/b?"},
+	}
+	for _, tt := range tests {
+		got, err := urlnorm.String(tt.in, tt.flags)
+		if err != nil {
+			t.Errorf("%s: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: want %s, got %s", tt.in, tt.want, got)
+		}
+	}
+}
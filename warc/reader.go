@@ -0,0 +1,211 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package warc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrFormat is returned when the input is not a WARC file.
+var ErrFormat = errors.New("warc: bad format")
+
+// countingReader counts the bytes read from r. It is an io.ByteReader so
+// gzip doesn't read past the end of a member.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// Reader reads records one at a time from a WARC file, gzipped per record
+// or not compressed.
+type Reader struct {
+	cr   *countingReader
+	gzip bool
+	z    *gzip.Reader
+	off  int64
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(2)
+	return &Reader{
+		cr:   &countingReader{r: br},
+		gzip: len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b,
+	}
+}
+
+// Offset returns the offset in the input of the last record returned by
+// Next.
+func (r *Reader) Offset() int64 {
+	return r.off
+}
+
+// Next returns the next record, or io.EOF at the end of the input.
+func (r *Reader) Next() (*Record, error) {
+	r.off = r.cr.n
+	if !r.gzip {
+		return readRecord(r.cr)
+	}
+	var err error
+	if r.z == nil {
+		r.z, err = gzip.NewReader(r.cr)
+	} else {
+		err = r.z.Reset(r.cr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.z.Multistream(false)
+	src := bufio.NewReader(r.z)
+	rec, err := readRecord(src)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(ioutil.Discard, src)
+	return rec, err
+}
+
+func readLine(r io.ByteReader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			if err == io.EOF && len(b) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if c == '\n' {
+			return strings.TrimRight(string(b), "\r"), nil
+		}
+		b = append(b, c)
+	}
+}
+
+func readRecord(r byteReader) (*Record, error) {
+	version, err := readLine(r)
+	for err == nil && version == "" {
+		// tolerate extra blank lines between records
+		version, err = readLine(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, ErrFormat
+	}
+	rec := &Record{Header: map[string]string{}}
+	length := int64(-1)
+	last := ""
+	for {
+		l, err := readLine(r)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if l == "" {
+			break
+		}
+		if (l[0] == ' ' || l[0] == '\t') && last != "" {
+			rec.Header[last] += " " + strings.TrimSpace(l)
+			continue
+		}
+		i := strings.IndexByte(l, ':')
+		if i < 0 {
+			return nil, ErrFormat
+		}
+		k, v := strings.TrimSpace(l[:i]), strings.TrimSpace(l[i+1:])
+		switch strings.ToLower(k) {
+		case "warc-type":
+			rec.Type = v
+		case "warc-record-id":
+			rec.ID = v
+		case "warc-date":
+			rec.Date, _ = time.Parse(time.RFC3339Nano, v)
+		case "warc-target-uri":
+			rec.TargetURI = strings.Trim(v, "<>")
+		case "content-type":
+			rec.ContentType = v
+		case "content-length":
+			length, err = strconv.ParseInt(v, 10, 64)
+			if err != nil || length < 0 {
+				return nil, ErrFormat
+			}
+		default:
+			rec.Header[k] = v
+			last = k
+			continue
+		}
+		last = ""
+	}
+	if length < 0 {
+		return nil, ErrFormat
+	}
+	rec.Block = make([]byte, length)
+	_, err = io.ReadFull(r, rec.Block)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	// the two CRLF ending the record
+	for i := 0; i < 2; i++ {
+		l, err := readLine(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if l != "" {
+			return nil, ErrFormat
+		}
+	}
+	return rec, nil
+}
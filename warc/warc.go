@@ -0,0 +1,138 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+// Package warc reads and writes WARC 1.1 files,
+// https://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/
+package warc // import "xojoc.pw/crawl/warc"
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Record types.
+const (
+	Warcinfo = "warcinfo"
+	Response = "response"
+	Resource = "resource"
+	Request  = "request"
+	Metadata = "metadata"
+	Revisit  = "revisit"
+)
+
+// Content types of the blocks.
+const (
+	HTTPResponse = "application/http; msgtype=response"
+	HTTPRequest  = "application/http; msgtype=request"
+	Fields       = "application/warc-fields"
+)
+
+// RevisitIdenticalPayload is the WARC-Profile of revisit records of
+// responses with the same payload as the record they refer to.
+const RevisitIdenticalPayload = "http://netpreserve.org/warc/1.1/revisit/identical-payload-digest"
+
+// Record is a WARC record.
+type Record struct {
+	Type        string
+	ID          string
+	Date        time.Time
+	TargetURI   string
+	ContentType string
+	// Header holds the named fields not above, like WARC-Payload-Digest
+	// or WARC-Concurrent-To. Names are as in the file.
+	Header map[string]string
+	Block  []byte
+}
+
+// Get returns the value of the named field, ignoring case.
+func (r *Record) Get(name string) string {
+	if v, ok := r.Header[name]; ok {
+		return v
+	}
+	for k, v := range r.Header {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// Set sets the value of the named field.
+func (r *Record) Set(name, value string) {
+	if r.Header == nil {
+		r.Header = map[string]string{}
+	}
+	for k := range r.Header {
+		if strings.EqualFold(k, name) {
+			delete(r.Header, k)
+		}
+	}
+	r.Header[name] = value
+}
+
+// Response parses the block of a response or revisit record. The body of
+// a revisit record is empty.
+func (r *Record) Response() (*http.Response, error) {
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(r.Block)), nil)
+}
+
+// Payload returns the payload of an HTTP block: what follows the headers.
+func (r *Record) Payload() []byte {
+	if !strings.HasPrefix(r.ContentType, "application/http") {
+		return r.Block
+	}
+	if i := bytes.Index(r.Block, []byte("\r\n\r\n")); i >= 0 {
+		return r.Block[i+4:]
+	}
+	return nil
+}
+
+// NewID returns a new record ID.
+func NewID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// Digest returns the digest of b as used in WARC-Block-Digest and
+// WARC-Payload-Digest.
+func Digest(b []byte) string {
+	s := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(s[:])
+}
+
+// FieldsBlock returns the application/warc-fields block of fields.
+func FieldsBlock(fields map[string]string) []byte {
+	ks := make([]string, 0, len(fields))
+	for k := range fields {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	var buf bytes.Buffer
+	for _, k := range ks {
+		fmt.Fprintf(&buf, "%s: %s\r\n", k, fields[k])
+	}
+	return buf.Bytes()
+}
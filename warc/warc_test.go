@@ -0,0 +1,134 @@
+package warc_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"xojoc.pw/crawl/warc"
+)
+
+func TestWriteRead(t *testing.T) {
+	var buf bytes.Buffer
+	w := warc.NewWriter(&buf)
+	date := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	u := "http://example.com/"
+
+	info, err := w.WriteInfo(map[string]string{"software": "crawl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &http.Response{
+		StatusCode: 200,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {"text/html"}},
+		Body:       ioutil.NopCloser(strings.NewReader("<p>hello</p>")),
+	}
+	rid, err := w.WriteResponse(u, date, resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "<p>hello</p>" {
+		t.Errorf("body not restored: %q", b)
+	}
+	req, _ := http.NewRequest("GET", u, nil)
+	if _, err := w.WriteRequest(u, date, req, rid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteMetadata(u, rid, map[string]string{"outlinks": "http://example.com/a"}); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body = ioutil.NopCloser(strings.NewReader("<p>hello</p>"))
+	revisitOff := w.Offset()
+	if _, err := w.WriteRevisit(u, date, resp, rid); err != nil {
+		t.Fatal(err)
+	}
+
+	r := warc.NewReader(bytes.NewReader(buf.Bytes()))
+	var recs []*warc.Record
+	var offs []int64
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		recs = append(recs, rec)
+		offs = append(offs, r.Offset())
+	}
+	types := []string{warc.Warcinfo, warc.Response, warc.Request, warc.Metadata, warc.Revisit}
+	if len(recs) != len(types) {
+		t.Fatalf("want %d records, got %d", len(types), len(recs))
+	}
+	for i, rec := range recs {
+		if rec.Type != types[i] || rec.ID == "" {
+			t.Errorf("record %d: want type %s, got %s %s", i, types[i], rec.Type, rec.ID)
+		}
+		if rec.Get("WARC-Block-Digest") != warc.Digest(rec.Block) {
+			t.Errorf("record %d: bad block digest", i)
+		}
+	}
+	if recs[0].ID != info || !strings.Contains(string(recs[0].Block), "software: crawl\r\n") {
+		t.Errorf("warcinfo: got %+v", recs[0])
+	}
+	rec := recs[1]
+	if rec.TargetURI != u || !rec.Date.Equal(date) || rec.ContentType != warc.HTTPResponse {
+		t.Errorf("response: got %+v", rec)
+	}
+	if rec.Get("warc-payload-digest") != warc.Digest([]byte("<p>hello</p>")) {
+		t.Errorf("response: bad payload digest %q", rec.Get("WARC-Payload-Digest"))
+	}
+	resp, err = rec.Response()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadAll(resp.Body); string(b) != "<p>hello</p>" || resp.Header.Get("Content-Type") != "text/html" {
+		t.Errorf("response: got %q %v", b, resp.Header)
+	}
+	if recs[2].Get("WARC-Concurrent-To") != rid || recs[3].Get("WARC-Refers-To") != rid {
+		t.Errorf("request and metadata don't refer to the response")
+	}
+	if rv := recs[4]; rv.Get("WARC-Refers-To") != rid || len(rv.Payload()) != 0 ||
+		rv.Get("WARC-Payload-Digest") != rec.Get("WARC-Payload-Digest") {
+		t.Errorf("revisit: got %+v", rv)
+	}
+
+	// a record can be read from its offset
+	if offs[4] != revisitOff {
+		t.Errorf("want offset %d, got %d", revisitOff, offs[4])
+	}
+	rec, err = warc.NewReader(bytes.NewReader(buf.Bytes()[offs[1]:])).Next()
+	if err != nil || rec.ID != rid {
+		t.Errorf("reading at offset: got %v %v", rec, err)
+	}
+}
+
+func TestReadUncompressed(t *testing.T) {
+	in := "WARC/1.0\r\nWARC-Type: resource\r\nWARC-Target-URI: <http://example.com/a>\r\n" +
+		"WARC-Record-ID: <urn:uuid:1>\r\nWARC-Date: 2018-01-02T03:04:05Z\r\nContent-Length: 5\r\n\r\nhello\r\n\r\n" +
+		"WARC/1.0\r\nWARC-Type: resource\r\nContent-Length: 0\r\n\r\n\r\n\r\n"
+	r := warc.NewReader(strings.NewReader(in))
+	rec, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec.TargetURI != "http://example.com/a" || string(rec.Block) != "hello" || rec.ID != "<urn:uuid:1>" {
+		t.Errorf("got %+v", rec)
+	}
+	if _, err := r.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("want EOF, got %v", err)
+	}
+	if _, err := warc.NewReader(strings.NewReader("HTTP/1.1 200 OK\r\n")).Next(); err != warc.ErrFormat {
+		t.Errorf("want %v, got %v", warc.ErrFormat, err)
+	}
+}
@@ -0,0 +1,196 @@
+/*  Copyright (C) 2018 Alexandru Cojocaru
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as
+published by the Free Software Foundation, either version 3 of the
+License, or (at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>. */
+
+package warc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Writer writes records, each in its own gzip member so that a record can
+// be read without the ones before it.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+	n  int64
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Offset returns the number of bytes written, that is where the next
+// record starts.
+func (w *Writer) Offset() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.n
+}
+
+// Write writes r, setting its ID and Date if empty and WARC-Block-Digest.
+// It returns the offset of r.
+func (w *Writer) Write(r *Record) (int64, error) {
+	if r.ID == "" {
+		r.ID = NewID()
+	}
+	if r.Date.IsZero() {
+		r.Date = time.Now()
+	}
+	r.Set("WARC-Block-Digest", Digest(r.Block))
+
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	fmt.Fprintf(z, "WARC/1.1\r\n")
+	fmt.Fprintf(z, "WARC-Type: %s\r\n", r.Type)
+	fmt.Fprintf(z, "WARC-Record-ID: %s\r\n", r.ID)
+	fmt.Fprintf(z, "WARC-Date: %s\r\n", r.Date.UTC().Format(time.RFC3339))
+	if r.TargetURI != "" {
+		fmt.Fprintf(z, "WARC-Target-URI: %s\r\n", r.TargetURI)
+	}
+	ks := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	for _, k := range ks {
+		fmt.Fprintf(z, "%s: %s\r\n", k, r.Header[k])
+	}
+	if r.ContentType != "" {
+		fmt.Fprintf(z, "Content-Type: %s\r\n", r.ContentType)
+	}
+	fmt.Fprintf(z, "Content-Length: %d\r\n\r\n", len(r.Block))
+	z.Write(r.Block)
+	fmt.Fprintf(z, "\r\n\r\n")
+	err := z.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	off := w.n
+	n, err := w.w.Write(buf.Bytes())
+	w.n += int64(n)
+	return off, err
+}
+
+// WriteInfo writes a warcinfo record with fields, like software or
+// operator, and returns its ID.
+func (w *Writer) WriteInfo(fields map[string]string) (string, error) {
+	r := &Record{Type: Warcinfo, ContentType: Fields, Block: FieldsBlock(fields)}
+	_, err := w.Write(r)
+	return r.ID, err
+}
+
+// httpBlock returns the block of resp, with the whole body, and the body.
+func httpBlock(resp *http.Response) ([]byte, []byte, error) {
+	var body []byte
+	if resp.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	c := *resp
+	c.Body = ioutil.NopCloser(bytes.NewReader(body))
+	c.ContentLength = int64(len(body))
+	c.TransferEncoding = nil
+	var buf bytes.Buffer
+	err := c.Write(&buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), body, nil
+}
+
+// NewResponse returns a response record for resp, fetched at date. The
+// body of resp is read and replaced with an equivalent one.
+func NewResponse(uri string, date time.Time, resp *http.Response) (*Record, error) {
+	block, body, err := httpBlock(resp)
+	if err != nil {
+		return nil, err
+	}
+	r := &Record{Type: Response, Date: date, TargetURI: uri, ContentType: HTTPResponse, Block: block}
+	r.Set("WARC-Payload-Digest", Digest(body))
+	return r, nil
+}
+
+// WriteResponse writes a response record for resp, fetched at date, and
+// returns its ID. The body of resp is read and replaced with an equivalent
+// one.
+func (w *Writer) WriteResponse(uri string, date time.Time, resp *http.Response) (string, error) {
+	r, err := NewResponse(uri, date, resp)
+	if err != nil {
+		return "", err
+	}
+	_, err = w.Write(r)
+	return r.ID, err
+}
+
+// WriteRequest writes a request record for req, which has no body, made
+// for the record concurrentTo, if not empty, and returns its ID.
+func (w *Writer) WriteRequest(uri string, date time.Time, req *http.Request, concurrentTo string) (string, error) {
+	var buf bytes.Buffer
+	err := req.Write(&buf)
+	if err != nil {
+		return "", err
+	}
+	r := &Record{Type: Request, Date: date, TargetURI: uri, ContentType: HTTPRequest, Block: buf.Bytes()}
+	if concurrentTo != "" {
+		r.Set("WARC-Concurrent-To", concurrentTo)
+	}
+	_, err = w.Write(r)
+	return r.ID, err
+}
+
+// WriteMetadata writes a metadata record with fields about the record
+// refersTo and returns its ID.
+func (w *Writer) WriteMetadata(uri string, refersTo string, fields map[string]string) (string, error) {
+	r := &Record{Type: Metadata, TargetURI: uri, ContentType: Fields, Block: FieldsBlock(fields)}
+	if refersTo != "" {
+		r.Set("WARC-Refers-To", refersTo)
+	}
+	_, err := w.Write(r)
+	return r.ID, err
+}
+
+// WriteRevisit writes a revisit record for resp, whose payload is the same
+// as the one of the record refersTo, and returns its ID. Only the headers
+// of resp are written.
+func (w *Writer) WriteRevisit(uri string, date time.Time, resp *http.Response, refersTo string) (string, error) {
+	block, body, err := httpBlock(resp)
+	if err != nil {
+		return "", err
+	}
+	block = block[:len(block)-len(body)]
+	r := &Record{Type: Revisit, Date: date, TargetURI: uri, ContentType: HTTPResponse, Block: block}
+	r.Set("WARC-Profile", RevisitIdenticalPayload)
+	r.Set("WARC-Refers-To", refersTo)
+	r.Set("WARC-Payload-Digest", Digest(body))
+	_, err = w.Write(r)
+	return r.ID, err
+}